@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// apiVersionPrefix is the path prefix of the current REST API, unprefixed routes are deprecated aliases
+const apiVersionPrefix = "/v1"
+
+// requestIDHeader carries the ID correlating a request with its logs and error responses
+const requestIDHeader = "X-Request-ID"
+
+// newRouter builds the HTTP router serving the /v1 API and its deprecated unversioned aliases,
+// failing when its routes disagree with the OpenAPI document
+func newRouter() (*mux.Router, error) {
+	router := mux.NewRouter()
+	router.Use(requestIDMiddleware)
+	router.Use(openAPIValidationMiddleware)
+	router.Use(idempotencyMiddleware)
+	registerRoutes(router.PathPrefix(apiVersionPrefix).Subrouter())
+	legacy := router.PathPrefix("/").Subrouter()
+	legacy.Use(deprecationMiddleware)
+	registerRoutes(legacy)
+	// mux runs no middleware for unmatched requests, so the request ID is added here
+	router.NotFoundHandler = requestIDMiddleware(routeNotFoundHandler(router))
+	router.MethodNotAllowedHandler = router.NotFoundHandler
+	if err := checkRouteContract(router, apiVersionPrefix); err != nil {
+		return nil, err
+	}
+	return router, nil
+}
+
+// registerRoutes adds every REST and real-time route to the router
+func registerRoutes(router *mux.Router) {
+	router.HandleFunc("/login", transcode).Methods("POST")
+	router.HandleFunc("/register", transcode).Methods("POST")
+	router.HandleFunc("/logout", transcode).Methods("POST")
+	router.HandleFunc("/ws", handleWebSocket)
+	router.HandleFunc("/schema/events.json", handleEventSchema).Methods("GET")
+	router.HandleFunc("/openapi.json", handleOpenAPI).Methods("GET")
+	router.HandleFunc("/sessions", handleSessions)
+	router.HandleFunc("/sessions/{id}", handleSessions)
+	router.HandleFunc("/sessions/{id}/ballots", getBallotsHandler).Methods("GET")
+	router.HandleFunc("/sessions/{id}/events", handleSessionEvents).Methods("GET")
+	router.HandleFunc("/sessions/{id}/chat", getChatHandler).Methods("GET")
+	router.HandleFunc("/sessions/{id}/close", closeSessionHandler).Methods("POST")
+	router.HandleFunc("/bulk/sessions", bulkCreateHandler).Methods("POST")
+	router.HandleFunc("/bulk/sessions/close", bulkCloseHandler).Methods("POST")
+	router.HandleFunc("/bulk/sessions/delete", bulkDeleteHandler).Methods("POST")
+	router.HandleFunc("/delegations", handleDelegations).Methods("GET", "POST", "DELETE")
+	router.HandleFunc("/webhooks", handleWebhooks).Methods("GET", "POST")
+	router.HandleFunc("/webhooks/{id}", deleteWebhookHandler).Methods("DELETE")
+	router.HandleFunc("/webhooks/{id}/enable", enableWebhookHandler).Methods("POST")
+	router.HandleFunc("/webhooks/{id}/deliveries", getWebhookDeliveriesHandler).Methods("GET")
+	router.HandleFunc("/webhooks/{id}/deliveries/{deliveryId}/replay", replayWebhookDeliveryHandler).Methods("POST")
+	router.HandleFunc("/chatops/commands", handleChatOpsCommand).Methods("POST")
+	router.HandleFunc("/chatops/actions", handleChatOpsAction).Methods("POST")
+	router.HandleFunc("/graphql", serveGraphQLWS).Methods("GET")
+	router.HandleFunc("/graphql", handleGraphQL).Methods("POST")
+}
+
+// routeNotFoundHandler answers requests no route matched with a JSON 404, or a 405 listing the allowed methods when
+// the path is served with other methods. The methods are probed because subrouters lose mux's own 405 detection.
+func routeNotFoundHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			var match mux.RouteMatch
+			if method != r.Method && router.Match(probe, &match) && match.MatchErr == nil {
+				allowed = append(allowed, method)
+			}
+		}
+		if len(allowed) == 0 {
+			sendError(w, "No route for "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		sendError(w, r.Method+" is not allowed on "+r.URL.Path, http.StatusMethodNotAllowed)
+	})
+}
+
+// requestIDMiddleware reuses the caller's request ID or assigns one, and echoes it in the response
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if requestID == "" {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deprecationMiddleware marks the unversioned aliases as deprecated and points to their /v1 successor
+func deprecationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+apiVersionPrefix+r.URL.Path+">; rel=\"successor-version\"")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sendError writes a structured JSON error, it takes the same arguments as http.Error
+func sendError(w http.ResponseWriter, message string, statusCode int) {
+	sendErrorDetails(w, message, statusCode, nil)
+}
+
+// sendErrorDetails writes a structured JSON error with details about what was wrong
+func sendErrorDetails(w http.ResponseWriter, message string, statusCode int, details interface{}) {
+	SendResponse(w, statusCode, APIError{
+		Code:      errorCode(statusCode),
+		Message:   message,
+		Details:   details,
+		RequestID: w.Header().Get(requestIDHeader),
+	})
+}
+
+// writeError reports an error with its status, defaulting to 500 for unexpected errors
+func writeError(w http.ResponseWriter, err error) {
+	if se, ok := err.(*statusError); ok {
+		sendErrorDetails(w, se.message, se.status, se.details)
+		return
+	}
+	sendError(w, err.Error(), http.StatusInternalServerError)
+}
+
+// errorCode returns the machine readable code of an HTTP status
+func errorCode(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusPreconditionFailed:
+		return "precondition_failed"
+	case http.StatusUnprocessableEntity:
+		return "unprocessable"
+	case http.StatusPreconditionRequired:
+		return "precondition_required"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	case http.StatusGatewayTimeout:
+		return "timeout"
+	}
+	if statusCode >= 500 {
+		return "internal"
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(statusCode)), " ", "_")
+}
+
+// grpcHTTPStatus maps the status of a failed auth service call to an HTTP status
+func grpcHTTPStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.OutOfRange:
+		return http.StatusUnprocessableEntity
+	case codes.Unimplemented:
+		return http.StatusMethodNotAllowed
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// grpcErrorMessage returns the message of a failed auth service call
+func grpcErrorMessage(err error, fallback string) string {
+	if s, ok := status.FromError(err); ok && s.Message() != "" && s.Code() != codes.Unknown {
+		return s.Message()
+	}
+	return fallback
+}
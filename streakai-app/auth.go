@@ -2,130 +2,73 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	pb "streakai/grpc"
-)
 
-// handleLogin processes login requests
-func handleLogin(w http.ResponseWriter, r *http.Request) {
-	log.Println("Login handler hit")
-	var user User
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
-		return
+// isAuthorised checks if the user is authorized, reusing the username of a request the middleware already authenticated
+func isAuthorised(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if username, ok := r.Context().Value(usernameKey{}).(string); ok {
+		return username, true
 	}
-
-	if err := json.Unmarshal(body, &user); err != nil {
-		http.Error(w, "Error parsing request body", http.StatusBadRequest)
-		return
+	tokenString := r.Header.Get("Authorization")
+	if tokenString == "" {
+		sendError(w, "Missing authorization header", http.StatusUnauthorized)
+		return "", false
 	}
+	tokenString = strings.TrimPrefix(tokenString, "Bearer ")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-
-	resp, err := grpcClient.Login(ctx, &pb.LoginRequest{Username: user.Username, Password: user.Password})
+	username, err := checkToken(tokenString)
 	if err != nil {
-		http.Error(w, "Login failed", http.StatusUnauthorized)
-		log.Printf("gRPC login call failed: %v", err)
-		return
+		writeError(w, err)
+		return "", false
 	}
-
-	SendResponse(w, http.StatusOK, map[string]string{"token": resp.Token})
-	log.Println("Login successful")
+	return username, true
 }
 
-// handleRegister processes registration requests
-func handleRegister(w http.ResponseWriter, r *http.Request) {
-	log.Println("Register handler hit")
-
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
-		log.Printf("Failed to decode request body: %v", err)
-		return
-	}
-	log.Printf("User: %+v", user)
-
+// checkToken asks the auth service whether a token is valid and returns its username
+func checkToken(tokenString string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	resp, err := grpcClient.Register(ctx, &pb.RegisterRequest{Username: user.Username, Password: user.Password})
-	if err != nil {
-		http.Error(w, "Registration failed", http.StatusInternalServerError)
-		log.Printf("gRPC registration call failed: %v", err)
-		return
+	resp, err := grpcClient.CheckAuthorized(ctx, &pb.CheckAuthorizedReq{AuthCode: tokenString})
+	if err != nil || !resp.Authorized {
+		log.Printf("gRPC authorization failed: %v", err)
+		// only an unreachable auth service is reported as such, any other failure means the token is invalid
+		statusCode := http.StatusUnauthorized
+		if code := status.Code(err); code == codes.Unavailable || code == codes.DeadlineExceeded {
+			statusCode = grpcHTTPStatus(err)
+		}
+		return "", &statusError{status: statusCode, message: "Not Authorized"}
 	}
-
-	SendResponse(w, http.StatusOK, map[string]string{"message": "Registration successful", "status": resp.Status})
-	log.Println("Registration successful")
+	return resp.Username, nil
 }
 
-// handleLogout processes logout requests
-func handleLogout(w http.ResponseWriter, r *http.Request) {
-	log.Println("Logout handler hit")
-	var userLogOutReq UserLogoutReq
-
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
-		return
+// tokenExpiry reads the exp claim of a JWT the auth service already validated
+func tokenExpiry(tokenString string) (time.Time, bool) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
 	}
-
-	if err := json.Unmarshal(body, &userLogOutReq); err != nil {
-		http.Error(w, "Error parsing request body", http.StatusBadRequest)
-		return
-	}
-
-	tokenString := r.Header.Get("Authorization")
-	if tokenString == "" {
-		http.Error(w, "Missing authorization header", http.StatusUnauthorized)
-		return
-	}
-	tokenString = tokenString[len("Bearer "):]
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-
-	resp, err := grpcClient.LogOut(ctx, &pb.LogOutRequest{Username: userLogOutReq.Username, AuthCode: tokenString})
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		http.Error(w, "Logout failed", http.StatusUnauthorized)
-		log.Printf("gRPC logout call failed: %v", err)
-		return
+		return time.Time{}, false
 	}
 
-	SendResponse(w, http.StatusOK, map[string]string{"status": resp.Status})
-	log.Println("Logout successful")
-}
-
-// isAuthorised checks if the user is authorized
-func isAuthorised(w http.ResponseWriter, r *http.Request) (string, bool) {
-	tokenString := r.Header.Get("Authorization")
-	if tokenString == "" {
-		http.Error(w, "Missing authorization header", http.StatusUnauthorized)
-		return "", false
+	var claims struct {
+		Exp int64 `json:"exp"`
 	}
-	tokenString = tokenString[len("Bearer "):]
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-
-	resp, err := grpcClient.CheckAuthorized(ctx, &pb.CheckAuthorizedReq{AuthCode: tokenString})
-	if err != nil || !resp.Authorized {
-		http.Error(w, "Not Authorized", http.StatusUnauthorized)
-		log.Printf("gRPC authorization failed: %v", err)
-		return "", false
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
 	}
-	return resp.Username, true
+	return time.Unix(claims.Exp, 0), true
 }
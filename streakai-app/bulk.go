@@ -0,0 +1,563 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// maxBulkItems is the most sessions a single bulk request may touch
+const maxBulkItems = 100
+
+// bulkRetries is how often a bulk write is retried when another replica changed one of its sessions meanwhile
+const bulkRetries = 3
+
+// bulkCreateHandler creates every session of the list from the template in one Redis transaction
+func bulkCreateHandler(w http.ResponseWriter, r *http.Request) {
+	username, isAuthorised := isAuthorised(w, r)
+	if !isAuthorised {
+		return
+	}
+
+	var request BulkCreateRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request.Sessions) == 0 || len(request.Sessions) > maxBulkItems {
+		sendError(w, fmt.Sprintf("sessions must list between 1 and %d items", maxBulkItems), http.StatusBadRequest)
+		return
+	}
+
+	response, err := bulkCreateSessions(username, &request.Template, request.Sessions)
+	if err != nil {
+		log.Printf("Error creating sessions: %v", err)
+		writeError(w, err)
+		return
+	}
+	SendResponse(w, http.StatusOK, response)
+}
+
+// bulkCloseHandler closes, and optionally archives, the listed sessions owned by the caller
+func bulkCloseHandler(w http.ResponseWriter, r *http.Request) {
+	username, request, ok := decodeBulkSessionsRequest(w, r)
+	if !ok {
+		return
+	}
+	response, err := bulkCloseSessions(username, request.Ids, request.Versions, request.Archive)
+	if err != nil {
+		log.Printf("Error closing sessions: %v", err)
+		writeError(w, err)
+		return
+	}
+	SendResponse(w, http.StatusOK, response)
+}
+
+// bulkDeleteHandler deletes the listed sessions owned by the caller, with their ballots, events, chat and webhooks
+func bulkDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	username, request, ok := decodeBulkSessionsRequest(w, r)
+	if !ok {
+		return
+	}
+	response, err := bulkDeleteSessions(username, request.Ids)
+	if err != nil {
+		log.Printf("Error deleting sessions: %v", err)
+		writeError(w, err)
+		return
+	}
+	SendResponse(w, http.StatusOK, response)
+}
+
+// decodeBulkSessionsRequest authenticates the caller and reads the list of session IDs to act on
+func decodeBulkSessionsRequest(w http.ResponseWriter, r *http.Request) (string, *BulkSessionsRequest, bool) {
+	username, isAuthorised := isAuthorised(w, r)
+	if !isAuthorised {
+		return "", nil, false
+	}
+
+	var request BulkSessionsRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return "", nil, false
+	}
+	if len(request.Ids) == 0 || len(request.Ids) > maxBulkItems {
+		sendError(w, fmt.Sprintf("ids must list between 1 and %d items", maxBulkItems), http.StatusBadRequest)
+		return "", nil, false
+	}
+	return username, &request, true
+}
+
+// bulkCreateSessions validates every item merged over the template and stores the valid ones in a single pipeline,
+// invalid items are reported without preventing the others from being created
+func bulkCreateSessions(owner string, template *VotingSession, items []VotingSession) (*BulkResponse, error) {
+	response := newBulkResponse(len(items))
+	prepared := map[int]*VotingSession{}
+	for i := range items {
+		session := applySessionTemplate(template, &items[i])
+		if err := prepareSession(owner, session); err != nil {
+			response.fail(i, "", err)
+			continue
+		}
+		session.Version = 1
+		prepared[i] = session
+	}
+
+	created, err := insertBulkSessions(prepared, response)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range created {
+		broadcastSessionStatus(eventSessionCreated, session)
+	}
+	response.count()
+	log.Printf("User %s created %d sessions in bulk", owner, response.Succeeded)
+	return response, nil
+}
+
+// insertBulkSessions writes the prepared sessions, keyed by their item index, in one transaction watching their keys.
+// Like insertSession it never overwrites an existing key, such an item gets a 409 and the others are still created.
+func insertBulkSessions(prepared map[int]*VotingSession, response *BulkResponse) ([]*VotingSession, error) {
+	if len(prepared) == 0 {
+		return nil, nil
+	}
+	indexes := make([]int, 0, len(prepared))
+	for i := range prepared {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	keys := make([]string, len(indexes))
+	for j, i := range indexes {
+		keys[j] = prepared[i].Id
+	}
+
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	var created []*VotingSession
+	for attempt := 0; attempt < bulkRetries; attempt++ {
+		err := redisClient.Watch(func(tx *redis.Tx) error {
+			values, err := tx.MGet(keys...).Result()
+			if err != nil {
+				return err
+			}
+			created = nil
+			for j, i := range indexes {
+				session := prepared[i]
+				if values[j] != nil {
+					response.fail(i, session.Id, &statusError{status: http.StatusConflict, message: "session already exists"})
+					continue
+				}
+				created = append(created, session)
+				response.Results[i] = BulkResult{Index: i, Id: session.Id, Status: http.StatusCreated}
+			}
+			if len(created) == 0 {
+				return nil
+			}
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				for _, session := range created {
+					sessionData, err := json.Marshal(session)
+					if err != nil {
+						return fmt.Errorf("failed to marshal session: %v", err)
+					}
+					writeSession(pipe, session, sessionData)
+				}
+				return nil
+			})
+			return err
+		}, keys...)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to set sessions in Redis: %v", err)
+		}
+		for _, session := range created {
+			cacheSession(session)
+		}
+		return created, nil
+	}
+	return nil, &statusError{status: http.StatusConflict, message: "sessions kept changing, please retry"}
+}
+
+// applySessionTemplate returns the item with its empty voting rules taken from the template
+func applySessionTemplate(template *VotingSession, item *VotingSession) *VotingSession {
+	session := *item
+	if session.Name == "" {
+		session.Name = template.Name
+	}
+	if session.Workspace == "" {
+		session.Workspace = template.Workspace
+	}
+	if session.Mode == "" {
+		session.Mode = template.Mode
+	}
+	if session.Options == nil {
+		session.Options = template.Options
+	}
+	if session.Credits == 0 {
+		session.Credits = template.Credits
+	}
+	if session.Dots == 0 {
+		session.Dots = template.Dots
+	}
+	if session.Quorum == 0 {
+		session.Quorum = template.Quorum
+	}
+	if session.Weights == nil {
+		session.Weights = template.Weights
+	}
+	return &session
+}
+
+// bulkCloseSessions freezes the tally of every open session of the list and, when archiving, removes them from the
+// session lists. A session listed in versions is only closed at that version. All writes go out in one transaction
+// watching the sessions, retried if another write raced it.
+func bulkCloseSessions(username string, ids []string, versions map[string]int64, archive bool) (*BulkResponse, error) {
+	ballotMutex.Lock()
+	defer ballotMutex.Unlock()
+
+	var response *BulkResponse
+	var changed []*VotingSession
+	var closed map[string]bool
+	err := watchBulkSessions(ids, func(tx *redis.Tx, stored map[int]*VotingSession) error {
+		response = newBulkResponse(len(ids))
+		changed, closed = nil, map[string]bool{}
+		checkBulkSessions(username, ids, stored, response, "Only the session owner can close it")
+		for i, session := range stored {
+			if response.Results[i].Status != 0 {
+				continue
+			}
+			if version, ok := versions[session.Id]; ok && version != session.Version {
+				response.fail(i, session.Id, errVersionConflict)
+				continue
+			}
+			if session.Closed && (!archive || session.Archived) {
+				response.fail(i, session.Id, &statusError{status: http.StatusConflict, message: "session is already closed"})
+				continue
+			}
+			if !session.Closed {
+				tally, err := computeTally(session)
+				if err != nil {
+					response.fail(i, session.Id, err)
+					continue
+				}
+				session.Closed = true
+				session.ClosedAt = time.Now().Unix()
+				session.Result = &tally
+				closed[session.Id] = true
+			}
+			session.Archived = archive
+			session.Version++
+			changed = append(changed, session)
+			response.Results[i] = BulkResult{Index: i, Id: session.Id, Status: http.StatusOK}
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+
+		sessionMutex.Lock()
+		defer sessionMutex.Unlock()
+		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, session := range changed {
+				sessionData, err := json.Marshal(session)
+				if err != nil {
+					return fmt.Errorf("failed to marshal session: %v", err)
+				}
+				if session.Archived {
+					pipe.Set(session.Id, sessionData, 0)
+					unindexSession(pipe, session)
+				} else {
+					writeSession(pipe, session, sessionData)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, session := range changed {
+			if session.Archived {
+				uncacheSession(session.Id)
+			} else {
+				cacheSession(session)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, session := range changed {
+		if closed[session.Id] {
+			broadcastSessionStatus(eventSessionClosed, session)
+		} else {
+			broadcastSessionStatus(eventSessionUpdated, session)
+		}
+	}
+	response.count()
+	log.Printf("User %s closed %d sessions in bulk, archive %t", username, response.Succeeded, archive)
+	return response, nil
+}
+
+// bulkDeleteSessions removes every session of the list with all the keys stored for it in one transaction
+func bulkDeleteSessions(username string, ids []string) (*BulkResponse, error) {
+	ballotMutex.Lock()
+	defer ballotMutex.Unlock()
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+
+	var response *BulkResponse
+	var deleted []*VotingSession
+	err := watchBulkSessions(ids, func(tx *redis.Tx, stored map[int]*VotingSession) error {
+		response = newBulkResponse(len(ids))
+		deleted = nil
+		checkBulkSessions(username, ids, stored, response, "Only the session owner can delete it")
+		webhooks := map[string][]*Webhook{}
+		for i, session := range stored {
+			if response.Results[i].Status != 0 {
+				continue
+			}
+			sessionWebhooks, err := getSessionWebhooks(tx, session.Id)
+			if err != nil {
+				return err
+			}
+			webhooks[session.Id] = sessionWebhooks
+			deleted = append(deleted, session)
+			response.Results[i] = BulkResult{Index: i, Id: session.Id, Status: http.StatusOK}
+		}
+		if len(deleted) == 0 {
+			return nil
+		}
+		scheduled, err := getScheduledDeliveries(tx, webhooks)
+		if err != nil {
+			return err
+		}
+
+		sessionMutex.Lock()
+		defer sessionMutex.Unlock()
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, session := range deleted {
+				pipe.Del(session.Id, ballotsKey(session.Id), eventLogKey(session.Id), eventSeqKey(session.Id), chatKey(session.Id), mutedKey(session.Id),
+					presenceKey(session.Id), sessionDelegationsKey(session.Id), sessionWebhooksKey(session.Id))
+				pipe.SRem(presenceSessionsKey, session.Id)
+				unindexSession(pipe, session)
+				for _, webhook := range webhooks[session.Id] {
+					pipe.Del(webhookKey(webhook.Id), webhookDeliveriesKey(webhook.Id), webhookDeliveryOrderKey(webhook.Id), webhookFailuresKey(webhook.Id))
+					pipe.SRem(userWebhooksKey(webhook.Owner), webhook.Id)
+				}
+			}
+			if len(scheduled) > 0 {
+				pipe.ZRem(webhookScheduleKey, scheduled...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, session := range deleted {
+			uncacheSession(session.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, session := range deleted {
+		broadcastSessionDeleted(session)
+	}
+	response.count()
+	log.Printf("User %s deleted %d sessions in bulk", username, response.Succeeded)
+	return response, nil
+}
+
+// watchBulkSessions loads the listed sessions in one MGET inside a WATCH on their keys and runs fn, which writes them
+// through the transaction. fn is run again with fresh sessions when another write changed one of them meanwhile.
+func watchBulkSessions(ids []string, fn func(tx *redis.Tx, stored map[int]*VotingSession) error) error {
+	keys := uniqueIDs(ids)
+	for attempt := 0; attempt < bulkRetries; attempt++ {
+		err := redisClient.Watch(func(tx *redis.Tx) error {
+			values, err := tx.MGet(keys...).Result()
+			if err != nil {
+				return fmt.Errorf("failed to get sessions from Redis: %v", err)
+			}
+			byID := make(map[string]string, len(keys))
+			for i, value := range values {
+				if data, ok := value.(string); ok {
+					byID[keys[i]] = data
+				}
+			}
+
+			stored := map[int]*VotingSession{}
+			seen := map[string]bool{}
+			for i, id := range ids {
+				data, ok := byID[id]
+				if !ok || seen[id] {
+					continue
+				}
+				seen[id] = true
+				var session VotingSession
+				if err := json.Unmarshal([]byte(data), &session); err != nil || session.Id != id {
+					// another kind of record, not a session
+					continue
+				}
+				stored[i] = &session
+			}
+			return fn(tx, stored)
+		}, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return &statusError{status: http.StatusConflict, message: "sessions kept changing, please retry"}
+}
+
+// checkBulkSessions fails the items whose session is missing, listed twice or not owned by the user
+func checkBulkSessions(username string, ids []string, stored map[int]*VotingSession, response *BulkResponse, forbidden string) {
+	seen := map[string]bool{}
+	for i, id := range ids {
+		session, found := stored[i]
+		switch {
+		case seen[id]:
+			response.fail(i, id, &statusError{status: http.StatusConflict, message: "session is listed more than once"})
+		case !found:
+			response.fail(i, id, &statusError{status: http.StatusNotFound, message: "session not found"})
+		case session.Owner != username:
+			response.fail(i, id, &statusError{status: http.StatusForbidden, message: forbidden})
+		}
+		seen[id] = true
+	}
+}
+
+// getSessionWebhooks loads the webhooks registered for a session
+func getSessionWebhooks(tx *redis.Tx, sessionID string) ([]*Webhook, error) {
+	ids, err := tx.SMembers(sessionWebhooksKey(sessionID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhooks from Redis: %v", err)
+	}
+	webhooks := make([]*Webhook, 0, len(ids))
+	for _, id := range ids {
+		webhook, err := getWebhook(id)
+		if err != nil {
+			// removed meanwhile, only its index entry is left
+			continue
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+// getScheduledDeliveries returns the members of the webhook schedule that belong to one of the webhooks
+func getScheduledDeliveries(tx *redis.Tx, webhooks map[string][]*Webhook) ([]interface{}, error) {
+	prefixes := []string{}
+	for _, sessionWebhooks := range webhooks {
+		for _, webhook := range sessionWebhooks {
+			prefixes = append(prefixes, scheduledDeliveryMember(webhook.Id, ""))
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+	members, err := tx.ZRange(webhookScheduleKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scheduled webhook deliveries from Redis: %v", err)
+	}
+	scheduled := []interface{}{}
+	for _, member := range members {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(member, prefix) {
+				scheduled = append(scheduled, member)
+				break
+			}
+		}
+	}
+	return scheduled, nil
+}
+
+// unindexSession queues the commands removing a session from the session lists and those of its owner and voters
+func unindexSession(pipe redis.Pipeliner, session *VotingSession) {
+	pipe.SRem(allSessionsKey, session.Id)
+	if session.Workspace != "" {
+		pipe.SRem(workspaceSessionsKey(session.Workspace), session.Id)
+	}
+	if session.Owner != "" {
+		pipe.SRem(ownedSessionsKey(session.Owner), session.Id)
+	}
+	for _, voter := range sessionVoters(session) {
+		pipe.SRem(votedSessionsKey(voter), session.Id)
+	}
+}
+
+// uncacheSession drops the in-memory copy of a session, sessionMutex must be held
+func uncacheSession(sessionID string) {
+	for i, existing := range sessions {
+		if existing.Id == sessionID {
+			sessions = append(sessions[:i], sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// broadcastSessionDeleted tells the subscribers of a deleted session it is gone, the event is not kept for replay
+// since the session's event log was deleted with it
+func broadcastSessionDeleted(session *VotingSession) {
+	data, err := json.Marshal(&Event{
+		Version:   eventVersion,
+		Type:      eventSessionDeleted,
+		SessionID: session.Id,
+		Timestamp: time.Now().UTC(),
+		Payload:   map[string]string{"id": session.Id},
+	})
+	if err != nil {
+		log.Printf("Error encoding session data: %v", err)
+		return
+	}
+	publishEvent(BusMessage{SessionID: session.Id, Workspace: session.Workspace, Event: data})
+}
+
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+func newBulkResponse(size int) *BulkResponse {
+	return &BulkResponse{Results: make([]BulkResult, size)}
+}
+
+// fail records the error of one item, with the status and code it would have had as a single request
+func (response *BulkResponse) fail(index int, id string, err error) {
+	status, message := http.StatusInternalServerError, err.Error()
+	if se, ok := err.(*statusError); ok {
+		status, message = se.status, se.message
+	}
+	response.Results[index] = BulkResult{Index: index, Id: id, Status: status, Code: errorCode(status), Message: message}
+}
+
+// count totals the succeeded and failed items
+func (response *BulkResponse) count() {
+	response.Succeeded, response.Failed = 0, 0
+	for _, result := range response.Results {
+		if result.Status < 300 {
+			response.Succeeded++
+		} else {
+			response.Failed++
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+func TestBulkCloseChecksVersions(t *testing.T) {
+	current := createTestSession(t, "alice", `{"name":"current"}`)
+	stale := createTestSession(t, "alice", `{"name":"stale"}`)
+	unlisted := createTestSession(t, "alice", `{"name":"unlisted"}`)
+	read, err := getSession(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	castTestVote(t, "bob", stale)
+	session, err := getSession(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(BulkSessionsRequest{
+		Ids:      []string{current, stale, unlisted},
+		Versions: map[string]int64{current: session.Version, stale: read.Version},
+	})
+	resp, data := apiRequest(t, http.MethodPost, "/v1/bulk/sessions/close", "alice", nil, string(body))
+	expectStatus(t, resp, data, http.StatusOK)
+	var response BulkResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusPreconditionFailed, http.StatusOK} {
+		if response.Results[i].Status != want {
+			t.Errorf("item %d: %+v, want %d", i, response.Results[i], want)
+		}
+	}
+	if response.Results[1].Code != errorCode(http.StatusPreconditionFailed) {
+		t.Errorf("stale item code %q", response.Results[1].Code)
+	}
+	if session, _ := getSession(stale); session.Closed {
+		t.Errorf("the stale session was closed")
+	}
+}
+
+func TestBulkCreateReportsExistingSessions(t *testing.T) {
+	existing := createTestSession(t, "alice", `{"name":"existing"}`)
+	fresh := &VotingSession{Name: "fresh"}
+	if err := prepareSession("bob", fresh); err != nil {
+		t.Fatal(err)
+	}
+	response := newBulkResponse(2)
+	created, err := insertBulkSessions(map[int]*VotingSession{0: {Id: existing, Name: "overwrite", Owner: "bob"}, 1: fresh}, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || created[0] != fresh {
+		t.Errorf("created %v", created)
+	}
+	for i, want := range []int{http.StatusConflict, http.StatusCreated} {
+		if response.Results[i].Status != want {
+			t.Errorf("item %d: %+v, want %d", i, response.Results[i], want)
+		}
+	}
+	if session, err := getSession(existing); err != nil || session.Name != "existing" {
+		t.Errorf("the existing session was overwritten: %+v, %v", session, err)
+	}
+}
+
+func TestBulkDeleteRemovesSchedulesAndPresence(t *testing.T) {
+	sessionID := createTestSession(t, "alice", `{"name":"deleted with pending deliveries"}`)
+	webhook := registerTestWebhook(t, "alice", sessionID)
+	if err := scheduleWebhookDelivery(webhook.Id, "pending", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := addPresence(sessionID, "tab", "bob", time.Now().Add(presenceTTL)); err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(BulkSessionsRequest{Ids: []string{sessionID}})
+	resp, data := apiRequest(t, http.MethodPost, "/v1/bulk/sessions/delete", "alice", nil, string(body))
+	expectStatus(t, resp, data, http.StatusOK)
+	if err := redisClient.ZScore(webhookScheduleKey, scheduledDeliveryMember(webhook.Id, "pending")).Err(); err != redis.Nil {
+		t.Errorf("the delivery is still scheduled: %v", err)
+	}
+	if redisClient.SIsMember(presenceSessionsKey, sessionID).Val() {
+		t.Errorf("the session is still swept for presence")
+	}
+}
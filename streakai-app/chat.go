@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Chat and reaction event types
+const (
+	eventReaction    = "reaction.added"
+	eventChatMessage = "chat.message"
+	eventChatDeleted = "chat.deleted"
+	eventChatMuted   = "chat.muted"
+)
+
+const (
+	// maxChatLength is the longest chat message accepted, in characters
+	maxChatLength = 500
+	// maxReactionLength keeps reactions to a single emoji or short code
+	maxReactionLength = 32
+	// chatRateLimit and reactionRateLimit cap what one user may send per rateWindow in a session
+	chatRateLimit     = 5
+	reactionRateLimit = 20
+	rateWindow        = 10 * time.Second
+)
+
+// loadChatSession returns an open session the user may post to
+func loadChatSession(username string, sessionID string) (*VotingSession, error) {
+	session, err := getSession(sessionID)
+	if err != nil {
+		return nil, &statusError{status: http.StatusNotFound, message: "Session not found"}
+	}
+	muted, err := isMuted(sessionID, username)
+	if err != nil {
+		return nil, err
+	}
+	if muted {
+		return nil, &statusError{status: http.StatusForbidden, message: "You are muted in this session"}
+	}
+	return session, nil
+}
+
+// checkRateLimit counts an action of the user and rejects it once the limit for the window is reached
+func checkRateLimit(kind string, sessionID string, username string, limit int64) error {
+	count, err := incrementRateCounter(kind, sessionID, username, rateWindow)
+	if err != nil {
+		return err
+	}
+	if count > limit {
+		return &statusError{status: http.StatusTooManyRequests, message: "Slow down, too many " + kind + " messages"}
+	}
+	return nil
+}
+
+// react sends an ephemeral reaction to everyone viewing the session, it is neither stored nor replayed so its seq is 0
+func react(username string, sessionID string, emoji string) error {
+	emoji = strings.TrimSpace(emoji)
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxReactionLength {
+		return &statusError{status: http.StatusBadRequest, message: "A short reaction is required"}
+	}
+	session, err := loadChatSession(username, sessionID)
+	if err != nil {
+		return err
+	}
+	if err := checkRateLimit("reaction", sessionID, username, reactionRateLimit); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&Event{
+		Version:   eventVersion,
+		Type:      eventReaction,
+		SessionID: sessionID,
+		Timestamp: time.Now().UTC(),
+		Payload:   map[string]string{"user": username, "emoji": emoji},
+	})
+	if err != nil {
+		return err
+	}
+	publishEvent(BusMessage{SessionID: sessionID, Workspace: session.Workspace, Event: data})
+	return nil
+}
+
+// postChatMessage stores a chat message for the session's lifetime and broadcasts it
+func postChatMessage(username string, sessionID string, text string) (*ChatMessage, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, &statusError{status: http.StatusBadRequest, message: "Message text is required"}
+	}
+	if utf8.RuneCountInString(text) > maxChatLength {
+		return nil, &statusError{status: http.StatusBadRequest, message: fmt.Sprintf("Messages are limited to %d characters", maxChatLength)}
+	}
+	session, err := loadChatSession(username, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRateLimit("chat", sessionID, username, chatRateLimit); err != nil {
+		return nil, err
+	}
+
+	message := &ChatMessage{
+		Id:        uuid.New().String(),
+		User:      username,
+		Text:      text,
+		Timestamp: time.Now().UTC(),
+	}
+	if err := appendChatMessage(sessionID, message); err != nil {
+		return nil, err
+	}
+	broadcastChatEvent(session, eventChatMessage, message)
+	return message, nil
+}
+
+// deleteChatMessage lets the owner remove a message from the session's chat
+func deleteChatMessage(username string, sessionID string, messageID string) error {
+	session, err := loadOwnedSession(username, sessionID)
+	if err != nil {
+		return err
+	}
+	deleted, err := removeChatMessage(sessionID, messageID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return &statusError{status: http.StatusNotFound, message: "Message not found"}
+	}
+	broadcastChatEvent(session, eventChatDeleted, map[string]string{"id": messageID})
+	return nil
+}
+
+// setMuted lets the owner mute or unmute a user's chat messages and reactions in the session
+func setMuted(username string, sessionID string, user string, muted bool) error {
+	if user == "" {
+		return &statusError{status: http.StatusBadRequest, message: "A user is required"}
+	}
+	session, err := loadOwnedSession(username, sessionID)
+	if err != nil {
+		return err
+	}
+	if err := setUserMuted(sessionID, user, muted); err != nil {
+		return err
+	}
+	broadcastChatEvent(session, eventChatMuted, map[string]interface{}{"user": user, "muted": muted})
+	return nil
+}
+
+// loadOwnedSession returns the session if the user owns it
+func loadOwnedSession(username string, sessionID string) (*VotingSession, error) {
+	session, err := getSession(sessionID)
+	if err != nil {
+		return nil, &statusError{status: http.StatusNotFound, message: "Session not found"}
+	}
+	if session.Owner != username {
+		return nil, &statusError{status: http.StatusForbidden, message: "Only the session owner can moderate the chat"}
+	}
+	return session, nil
+}
+
+// broadcastChatEvent publishes a chat event that is part of the session history
+func broadcastChatEvent(session *VotingSession, eventType string, payload interface{}) {
+	seq, err := nextEventSeq(session.Id)
+	if err != nil {
+		log.Printf("Error building %s event: %v", eventType, err)
+		return
+	}
+	broadcastEvent(session, &Event{
+		Version:   eventVersion,
+		Type:      eventType,
+		SessionID: session.Id,
+		Seq:       seq,
+		Timestamp: time.Now().UTC(),
+		Payload:   payload,
+	})
+}
+
+// getChatHandler returns the chat thread of a session
+func getChatHandler(w http.ResponseWriter, r *http.Request) {
+	if _, isAuthorised := isAuthorised(w, r); !isAuthorised {
+		return
+	}
+
+	sessionID := mux.Vars(r)["id"]
+	if _, err := getSession(sessionID); err != nil {
+		sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	messages, err := getChatMessages(sessionID)
+	if err != nil {
+		log.Printf("Error loading chat: %v", err)
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	SendResponse(w, http.StatusOK, messages)
+}
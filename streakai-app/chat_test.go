@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestReactionsAreNotReplayable(t *testing.T) {
+	sessionID := createTestSession(t, "alice", `{"name":"reactions"}`)
+	carol := subscribeTestClient(t, "carol", ClientMessage{SessionID: sessionID})
+
+	if err := react("bob", sessionID, "👍"); err != nil {
+		t.Fatal(err)
+	}
+	if reaction := nextTestEvent(t, carol, eventReaction); reaction.Seq != 0 {
+		t.Errorf("the reaction has seq %d", reaction.Seq)
+	}
+	if _, err := postChatMessage("bob", sessionID, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	message := nextTestEvent(t, carol, eventChatMessage)
+	missed, ok, err := replayEvents(sessionID, message.Seq-1)
+	if err != nil || !ok || len(missed) != 1 {
+		t.Errorf("replayed %d events after the reaction, %v", len(missed), err)
+	}
+
+	for i := int64(1); i < reactionRateLimit; i++ {
+		if err := react("bob", sessionID, "🎉"); err != nil {
+			t.Fatalf("reaction %d: %v", i+1, err)
+		}
+	}
+	if err := react("bob", sessionID, "🎉"); err == nil || err.(*statusError).status != http.StatusTooManyRequests {
+		t.Errorf("a reaction over the limit answered %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers signing chat-ops requests, the signature is v0=<hex HMAC-SHA256 of "v0:<timestamp>:<body>">
+const (
+	chatOpsTimestampHeader = "X-Streakai-Chatops-Timestamp"
+	chatOpsSignatureHeader = "X-Streakai-Chatops-Signature"
+)
+
+// chatOpsMaxSkew is how old a signed chat-ops request may be, older ones are rejected as replays
+const chatOpsMaxSkew = 5 * time.Minute
+
+const (
+	chatOpsInChannel = "in_channel"
+	chatOpsEphemeral = "ephemeral"
+)
+
+const chatOpsUsage = "Usage: /poll \"<question>\" [yes no | <option> <option> ...], /poll close <session-id> [<version>]"
+
+// chatOpsUserPrefix namespaces chat identities, app usernames cannot contain ':' so a chat user never acts as an app user
+const chatOpsUserPrefix = "chat:"
+
+// chatOpsSecret is shared with the chat platform to sign its requests, chat-ops is disabled without it
+var chatOpsSecret string
+
+// handleChatOpsCommand runs a slash command sent by the chat platform as a form with command, text, team and user
+func handleChatOpsCommand(w http.ResponseWriter, r *http.Request) {
+	body, ok := verifyChatOpsRequest(w, r)
+	if !ok {
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		sendError(w, "Invalid form body", http.StatusBadRequest)
+		return
+	}
+	user, err := chatOpsUsername(form.Get("team"), form.Get("user"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log.Printf("Chat-ops command from %s: %s %s", user, form.Get("command"), form.Get("text"))
+	SendResponse(w, http.StatusOK, runChatOpsCommand(user, form.Get("text")))
+}
+
+// handleChatOpsAction records the vote of a poll button clicked in the chat platform
+func handleChatOpsAction(w http.ResponseWriter, r *http.Request) {
+	body, ok := verifyChatOpsRequest(w, r)
+	if !ok {
+		return
+	}
+	var action ChatOpsAction
+	if err := json.Unmarshal(body, &action); err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := chatOpsUsername(action.Team, action.User)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	SendResponse(w, http.StatusOK, runChatOpsAction(user, action.Value))
+}
+
+// chatOpsUsername returns the streakai identity of a chat user, chat:<team>:<user>
+func chatOpsUsername(team string, user string) (string, error) {
+	if team == "" || user == "" {
+		return "", &statusError{status: http.StatusBadRequest, message: "team and user are required"}
+	}
+	if strings.Contains(team, ":") || strings.Contains(user, ":") {
+		return "", &statusError{status: http.StatusBadRequest, message: "team and user must not contain ':'"}
+	}
+	return chatOpsUserPrefix + team + ":" + user, nil
+}
+
+// verifyChatOpsRequest reads the body of a chat-ops request and checks its signature and age
+func verifyChatOpsRequest(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if chatOpsSecret == "" {
+		sendError(w, "Chat-ops integration is not configured", http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	defer r.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	timestamp := r.Header.Get(chatOpsTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		sendError(w, "Missing or invalid "+chatOpsTimestampHeader, http.StatusUnauthorized)
+		return nil, false
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > chatOpsMaxSkew || skew < -chatOpsMaxSkew {
+		sendError(w, "Request timestamp is too old", http.StatusUnauthorized)
+		return nil, false
+	}
+	expected := signChatOps(chatOpsSecret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(chatOpsSignatureHeader))) {
+		sendError(w, "Invalid request signature", http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
+}
+
+// signChatOps returns the signature header of a chat-ops request body sent at timestamp
+func signChatOps(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// runChatOpsCommand creates or closes a poll on behalf of the chat user, failures are replied ephemerally
+func runChatOpsCommand(user string, text string) *ChatOpsMessage {
+	args, err := splitCommandArgs(text)
+	if err != nil || len(args) == 0 || args[0] == "help" {
+		return &ChatOpsMessage{ResponseType: chatOpsEphemeral, Text: chatOpsUsage}
+	}
+
+	if args[0] == "close" {
+		if len(args) != 2 && len(args) != 3 {
+			return &ChatOpsMessage{ResponseType: chatOpsEphemeral, Text: chatOpsUsage}
+		}
+		return closeChatOpsPoll(user, args[1], args[2:])
+	}
+
+	session, err := newPollSession(args[0], args[1:])
+	if err != nil {
+		return &ChatOpsMessage{ResponseType: chatOpsEphemeral, Text: err.Error() + ". " + chatOpsUsage}
+	}
+	if err := createSession(user, session); err != nil {
+		return chatOpsError(err)
+	}
+	return &ChatOpsMessage{
+		ResponseType: chatOpsInChannel,
+		Text:         fmt.Sprintf("%s asks: %s", user[strings.LastIndex(user, ":")+1:], session.Name),
+		SessionID:    session.Id,
+		Buttons:      pollButtons(session),
+	}
+}
+
+// closeChatOpsPoll closes a poll at the version the user confirmed, like If-Match on POST /sessions/{id}/close.
+// Without a version it replies with the current one so the user can confirm what they are closing.
+func closeChatOpsPoll(user string, sessionID string, version []string) *ChatOpsMessage {
+	if len(version) == 0 {
+		session, err := getSession(sessionID)
+		if err != nil {
+			return &ChatOpsMessage{ResponseType: chatOpsEphemeral, Text: "Poll not found"}
+		}
+		return &ChatOpsMessage{
+			ResponseType: chatOpsEphemeral,
+			SessionID:    sessionID,
+			Text:         fmt.Sprintf("\"%s\" is at version %d, run /poll close %s %d to close it", session.Name, session.Version, sessionID, session.Version),
+		}
+	}
+	expected, err := strconv.ParseInt(version[0], 10, 64)
+	if err != nil || expected < 0 {
+		return &ChatOpsMessage{ResponseType: chatOpsEphemeral, Text: chatOpsUsage}
+	}
+	tally, err := closeSession(user, sessionID, expected)
+	if err != nil {
+		return chatOpsError(err)
+	}
+	return &ChatOpsMessage{ResponseType: chatOpsInChannel, SessionID: sessionID, Text: "Poll closed. " + formatTally(tally)}
+}
+
+// newPollSession builds a yes/no session, or a single choice dot-voting session when other options are given
+func newPollSession(question string, options []string) (*VotingSession, error) {
+	if question == "" {
+		return nil, fmt.Errorf("A question is required")
+	}
+	if len(options) == 0 || (len(options) == 2 && strings.EqualFold(options[0], "yes") && strings.EqualFold(options[1], "no")) {
+		return &VotingSession{Name: question}, nil
+	}
+	if len(options) < 2 {
+		return nil, fmt.Errorf("A poll needs at least two options")
+	}
+	return &VotingSession{Name: question, Mode: modeDots, Options: options, Dots: 1}, nil
+}
+
+// pollButtons returns a button per choice of the session, valued <session-id>|<choice>
+func pollButtons(session *VotingSession) []ChatOpsButton {
+	choices := session.Options
+	if session.Mode == modeBinary {
+		choices = []string{"yes", "no"}
+	}
+	buttons := make([]ChatOpsButton, 0, len(choices))
+	for _, choice := range choices {
+		buttons = append(buttons, ChatOpsButton{Label: choice, Value: session.Id + "|" + choice})
+	}
+	return buttons
+}
+
+// runChatOpsAction casts, or changes, the vote of the user who clicked a poll button
+func runChatOpsAction(user string, value string) *ChatOpsMessage {
+	sessionID, choice, ok := strings.Cut(value, "|")
+	if !ok || choice == "" {
+		return &ChatOpsMessage{ResponseType: chatOpsEphemeral, Text: "Unknown action"}
+	}
+	session, err := getSession(sessionID)
+	if err != nil {
+		return &ChatOpsMessage{ResponseType: chatOpsEphemeral, Text: "Poll not found"}
+	}
+
+	vote := SingleVote{Id: sessionID}
+	if session.Mode == modeBinary {
+		if choice != "yes" && choice != "no" {
+			return &ChatOpsMessage{ResponseType: chatOpsEphemeral, Text: "Unknown choice " + choice}
+		}
+		vote.Vote = choice == "yes"
+		vote.Change = alreadyVoted(session.YesCount, session.NoCount, user)
+	} else {
+		vote.Allocation = map[string]int{choice: 1}
+	}
+
+	ballot, err := recordVote(user, vote)
+	if err != nil {
+		return chatOpsError(err)
+	}
+	return &ChatOpsMessage{
+		ResponseType: chatOpsEphemeral,
+		SessionID:    sessionID,
+		Text:         fmt.Sprintf("You voted %s on \"%s\" (receipt %s)", choice, session.Name, ballot.Hash),
+	}
+}
+
+// chatOpsError replies with the message of a failed command, the request itself succeeded
+func chatOpsError(err error) *ChatOpsMessage {
+	if _, ok := err.(*statusError); !ok {
+		log.Printf("Chat-ops command failed: %v", err)
+		return &ChatOpsMessage{ResponseType: chatOpsEphemeral, Text: "Something went wrong, please try again"}
+	}
+	return &ChatOpsMessage{ResponseType: chatOpsEphemeral, Text: err.Error()}
+}
+
+// formatTally summarises a tally as text, by option for option based sessions
+func formatTally(tally *Tally) string {
+	if len(tally.Options) == 0 {
+		return fmt.Sprintf("yes %g, no %g", tally.Yes, tally.No)
+	}
+	parts := make([]string, 0, len(tally.Options))
+	for _, option := range sortedKeys(tally.Options) {
+		parts = append(parts, fmt.Sprintf("%s %g", option, tally.Options[option]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// splitCommandArgs splits command text on spaces, keeping "double quoted" or “curly quoted” arguments together
+func splitCommandArgs(text string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+	for _, c := range text {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '"':
+			quote, inArg = '"', true
+		case c == '“':
+			quote, inArg = '”', true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testChatOpsSecret = "chatops-secret"
+
+// useChatOpsSecret configures chat-ops signing for one test
+func useChatOpsSecret(t *testing.T, secret string) {
+	previous := chatOpsSecret
+	chatOpsSecret = secret
+	t.Cleanup(func() { chatOpsSecret = previous })
+}
+
+// signedChatOpsRequest posts a body to a chat-ops endpoint signed with secret at the time
+func signedChatOpsRequest(t *testing.T, path string, body string, secret string, at time.Time) (*http.Response, []byte) {
+	t.Helper()
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return apiRequest(t, http.MethodPost, path, "", map[string]string{
+		"Content-Type":         "application/x-www-form-urlencoded",
+		chatOpsTimestampHeader: timestamp,
+		chatOpsSignatureHeader: signChatOps(secret, timestamp, []byte(body)),
+	}, body)
+}
+
+// chatOpsCommand runs a signed /poll command as a user of team T1
+func chatOpsCommand(t *testing.T, user string, text string) *ChatOpsMessage {
+	t.Helper()
+	form := url.Values{"command": {"/poll"}, "text": {text}, "team": {"T1"}, "user": {user}}
+	resp, data := signedChatOpsRequest(t, "/v1/chatops/commands", form.Encode(), testChatOpsSecret, time.Now())
+	expectStatus(t, resp, data, http.StatusOK)
+	var message ChatOpsMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		t.Fatal(err)
+	}
+	return &message
+}
+
+// chatOpsClick sends a signed button callback as a user of team T1
+func chatOpsClick(t *testing.T, user string, value string) *ChatOpsMessage {
+	t.Helper()
+	body, _ := json.Marshal(ChatOpsAction{Team: "T1", User: user, Value: value})
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	resp, data := apiRequest(t, http.MethodPost, "/v1/chatops/actions", "", map[string]string{
+		chatOpsTimestampHeader: timestamp,
+		chatOpsSignatureHeader: signChatOps(testChatOpsSecret, timestamp, body),
+	}, string(body))
+	expectStatus(t, resp, data, http.StatusOK)
+	var message ChatOpsMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		t.Fatal(err)
+	}
+	return &message
+}
+
+func TestChatOpsRejectsUnsignedRequests(t *testing.T) {
+	form := url.Values{"command": {"/poll"}, "text": {`"Ship it?"`}, "team": {"T1"}, "user": {"U1"}}.Encode()
+
+	resp, data := signedChatOpsRequest(t, "/v1/chatops/commands", form, testChatOpsSecret, time.Now())
+	expectStatus(t, resp, data, http.StatusServiceUnavailable)
+
+	useChatOpsSecret(t, testChatOpsSecret)
+	resp, data = apiRequest(t, http.MethodPost, "/v1/chatops/commands", "", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, form)
+	expectStatus(t, resp, data, http.StatusUnauthorized)
+	resp, data = signedChatOpsRequest(t, "/v1/chatops/commands", form, "another-secret", time.Now())
+	expectStatus(t, resp, data, http.StatusUnauthorized)
+	resp, data = signedChatOpsRequest(t, "/v1/chatops/commands", form, testChatOpsSecret, time.Now().Add(-chatOpsMaxSkew-time.Minute))
+	expectStatus(t, resp, data, http.StatusUnauthorized)
+	resp, data = signedChatOpsRequest(t, "/v1/chatops/commands", form, testChatOpsSecret, time.Now().Add(chatOpsMaxSkew+time.Minute))
+	expectStatus(t, resp, data, http.StatusUnauthorized)
+
+	// a signature covers the body it was made for
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	resp, data = apiRequest(t, http.MethodPost, "/v1/chatops/commands", "", map[string]string{
+		"Content-Type":         "application/x-www-form-urlencoded",
+		chatOpsTimestampHeader: timestamp,
+		chatOpsSignatureHeader: signChatOps(testChatOpsSecret, timestamp, []byte(form)),
+	}, strings.Replace(form, "U1", "U2", 1))
+	expectStatus(t, resp, data, http.StatusUnauthorized)
+
+	resp, data = signedChatOpsRequest(t, "/v1/chatops/commands", url.Values{"text": {"help"}, "user": {"U1"}}.Encode(), testChatOpsSecret, time.Now())
+	expectStatus(t, resp, data, http.StatusBadRequest)
+	resp, data = signedChatOpsRequest(t, "/v1/chatops/commands", form, testChatOpsSecret, time.Now())
+	expectStatus(t, resp, data, http.StatusOK)
+}
+
+func TestSplitCommandArgs(t *testing.T) {
+	for text, want := range map[string][]string{
+		`"Ship it?"`:                   {"Ship it?"},
+		`  "Lunch?"  pizza "dim sum" `: {"Lunch?", "pizza", "dim sum"},
+		`“Curly quotes?” yes no`:       {"Curly quotes?", "yes", "no"},
+		`close 1234 7`:                 {"close", "1234", "7"},
+		`Unquoted question`:            {"Unquoted", "question"},
+		`"" empty`:                     {"", "empty"},
+		"tabs\tand\nlines":             {"tabs", "and", "lines"},
+		`"quote"joined`:                {"quotejoined"},
+		``:                             nil,
+	} {
+		args, err := splitCommandArgs(text)
+		if err != nil || !reflect.DeepEqual(args, want) {
+			t.Errorf("splitCommandArgs(%q) = %q, %v, want %q", text, args, err, want)
+		}
+	}
+	if _, err := splitCommandArgs(`"unterminated`); err == nil {
+		t.Errorf("an unterminated quote was accepted")
+	}
+}
+
+func TestChatOpsPolls(t *testing.T) {
+	useChatOpsSecret(t, testChatOpsSecret)
+
+	for _, text := range []string{"", "help", `"unterminated`, `"Lunch?" pizza`, "close", "close a b c"} {
+		if message := chatOpsCommand(t, "U1", text); message.ResponseType != chatOpsEphemeral || message.SessionID != "" {
+			t.Errorf("/poll %s: %+v", text, message)
+		}
+	}
+
+	poll := chatOpsCommand(t, "U1", `"Ship it?" yes no`)
+	if poll.ResponseType != chatOpsInChannel || poll.Text != "U1 asks: Ship it?" || len(poll.Buttons) != 2 {
+		t.Fatalf("yes/no poll: %+v", poll)
+	}
+	session, err := getSession(poll.SessionID)
+	if err != nil || session.Owner != "chat:T1:U1" || session.Mode != modeBinary {
+		t.Fatalf("poll session %+v: %v", session, err)
+	}
+
+	// clicking the other button changes the vote
+	if message := chatOpsClick(t, "U2", poll.Buttons[0].Value); !strings.HasPrefix(message.Text, "You voted yes") {
+		t.Errorf("yes click: %+v", message)
+	}
+	if message := chatOpsClick(t, "U2", poll.Buttons[1].Value); !strings.HasPrefix(message.Text, "You voted no") {
+		t.Errorf("no click: %+v", message)
+	}
+	session, _ = getSession(poll.SessionID)
+	if len(session.YesCount) != 0 || !reflect.DeepEqual(session.NoCount, []string{"chat:T1:U2"}) {
+		t.Errorf("votes after changing: yes %v, no %v", session.YesCount, session.NoCount)
+	}
+	for _, value := range []string{poll.SessionID + "|maybe", poll.SessionID, "missing|yes"} {
+		if message := chatOpsClick(t, "U2", value); message.ResponseType != chatOpsEphemeral || strings.HasPrefix(message.Text, "You voted") {
+			t.Errorf("click %s: %+v", value, message)
+		}
+	}
+
+	options := chatOpsCommand(t, "U1", `"Lunch?" pizza "dim sum"`)
+	if options.ResponseType != chatOpsInChannel || len(options.Buttons) != 2 || options.Buttons[1].Value != options.SessionID+"|dim sum" {
+		t.Fatalf("options poll: %+v", options)
+	}
+	chatOpsClick(t, "U2", options.Buttons[0].Value)
+	chatOpsClick(t, "U2", options.Buttons[1].Value)
+	session, _ = getSession(options.SessionID)
+	if !reflect.DeepEqual(session.Allocations["chat:T1:U2"], map[string]int{"dim sum": 1}) {
+		t.Errorf("allocations after changing: %v", session.Allocations)
+	}
+
+	// closing needs the owner and the version they were shown
+	if message := chatOpsCommand(t, "U2", "close "+poll.SessionID+" 1"); message.ResponseType != chatOpsEphemeral || !strings.Contains(message.Text, "owner") {
+		t.Errorf("close by another user: %+v", message)
+	}
+	session, _ = getSession(poll.SessionID)
+	version := strconv.FormatInt(session.Version, 10)
+	if confirm := chatOpsCommand(t, "U1", "close "+poll.SessionID); !strings.Contains(confirm.Text, "is at version "+version) {
+		t.Errorf("close without a version: %+v", confirm)
+	}
+	if message := chatOpsCommand(t, "U1", "close "+poll.SessionID+" 1"); message.ResponseType != chatOpsEphemeral {
+		t.Errorf("close at a stale version: %+v", message)
+	}
+	closed := chatOpsCommand(t, "U1", "close "+poll.SessionID+" "+version)
+	if closed.ResponseType != chatOpsInChannel || closed.Text != "Poll closed. yes 0, no 1" {
+		t.Errorf("close: %+v", closed)
+	}
+	if message := chatOpsClick(t, "U3", poll.Buttons[0].Value); strings.HasPrefix(message.Text, "You voted") {
+		t.Errorf("voted on a closed poll: %+v", message)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// handleCommand runs a websocket command with the same logic as the REST handlers
+// and answers it with an acknowledgement or an error carrying the request ID
+func (c *Client) handleCommand(h *Hub, msg ClientMessage) {
+	payload, err := c.runCommand(msg)
+	reply := CommandReply{Type: "ack", RequestID: msg.RequestID, Payload: payload}
+	if err != nil {
+		log.Printf("WebSocket command %s failed: %v", msg.Action, err)
+		reply = CommandReply{Type: "error", RequestID: msg.RequestID, Status: http.StatusInternalServerError, Message: err.Error()}
+		if se, ok := err.(*statusError); ok {
+			reply.Status = se.status
+		}
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("Error encoding command reply: %v", err)
+		return
+	}
+	h.sendTo(c, data)
+}
+
+func (c *Client) runCommand(msg ClientMessage) (interface{}, error) {
+	switch msg.Action {
+	case "vote", "changeVote":
+		ballot, err := recordVote(c.username, SingleVote{
+			Id:         msg.SessionID,
+			Vote:       msg.Vote,
+			Allocation: msg.Allocation,
+			Change:     msg.Action == "changeVote",
+		})
+		if err != nil {
+			return nil, err
+		}
+		return VoteReceipt{SessionID: msg.SessionID, Seq: ballot.Seq, Voter: ballot.Voter, Hash: ballot.Hash}, nil
+	case "createSession":
+		if msg.Session == nil {
+			return nil, &statusError{status: http.StatusBadRequest, message: "A session is required"}
+		}
+		if err := createSession(c.username, msg.Session); err != nil {
+			return nil, err
+		}
+		return map[string]string{"sessionID": msg.Session.Id}, nil
+	case "snapshot":
+		session, err := getSession(msg.SessionID)
+		if err != nil {
+			return nil, &statusError{status: http.StatusNotFound, message: "Session not found"}
+		}
+		return sessionView(session)
+	case "nudge":
+		nudged, err := nudgeNonVoters(c.username, msg.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]string{"nudged": nudged}, nil
+	case "react":
+		return nil, react(c.username, msg.SessionID, msg.Emoji)
+	case "chat":
+		return postChatMessage(c.username, msg.SessionID, msg.Text)
+	case "chatHistory":
+		if _, err := getSession(msg.SessionID); err != nil {
+			return nil, &statusError{status: http.StatusNotFound, message: "Session not found"}
+		}
+		return getChatMessages(msg.SessionID)
+	case "deleteMessage":
+		return nil, deleteChatMessage(c.username, msg.SessionID, msg.MessageID)
+	case "mute", "unmute":
+		return nil, setMuted(c.username, msg.SessionID, msg.User, msg.Action == "mute")
+	default:
+		return nil, &statusError{status: http.StatusBadRequest, message: "Unknown action " + msg.Action}
+	}
+}
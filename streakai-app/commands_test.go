@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// commandReply sends the command over the socket and returns the reply carrying its request ID
+func commandReply(t *testing.T, conn *websocket.Conn, msg ClientMessage) map[string]interface{} {
+	t.Helper()
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var reply map[string]interface{}
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("no reply to %s: %v", msg.RequestID, err)
+		}
+		if reply["requestId"] == msg.RequestID {
+			return reply
+		}
+	}
+}
+
+func TestWebSocketCommandsAnswerRequestIDs(t *testing.T) {
+	conn, _, err := dialTestSocket(t, map[string]string{"Authorization": "Bearer token-commander"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := commandReply(t, conn, ClientMessage{Action: "createSession", RequestID: "create", Session: &VotingSession{Name: "over the socket"}})
+	payload, _ := reply["payload"].(map[string]interface{})
+	id, _ := payload["sessionID"].(string)
+	if reply["type"] != "ack" || id == "" {
+		t.Fatalf("create replied %v", reply)
+	}
+	if session, err := getSession(id); err != nil || session.Owner != "commander" {
+		t.Fatalf("created %+v, %v", session, err)
+	}
+
+	reply = commandReply(t, conn, ClientMessage{Action: "vote", RequestID: "vote", SessionID: id, Vote: true})
+	payload, _ = reply["payload"].(map[string]interface{})
+	if reply["type"] != "ack" || payload["sessionId"] != id || payload["hash"] == "" {
+		t.Errorf("vote replied %v", reply)
+	}
+
+	for _, failing := range []struct {
+		msg    ClientMessage
+		status int
+	}{
+		{ClientMessage{Action: "vote", RequestID: "twice", SessionID: id, Vote: true}, http.StatusConflict},
+		{ClientMessage{Action: "snapshot", RequestID: "missing", SessionID: "no-such-session"}, http.StatusNotFound},
+		{ClientMessage{Action: "shout", RequestID: "unknown"}, http.StatusBadRequest},
+	} {
+		reply := commandReply(t, conn, failing.msg)
+		if reply["type"] != "error" || reply["status"] != float64(failing.status) || reply["message"] == "" {
+			t.Errorf("%s replied %v, want status %d", failing.msg.RequestID, reply, failing.status)
+		}
+	}
+
+	reply = commandReply(t, conn, ClientMessage{Action: "changeVote", RequestID: "change", SessionID: id, Vote: false})
+	if reply["type"] != "ack" {
+		t.Errorf("change replied %v", reply)
+	}
+	if tally := getTestTally(t, id); tally.No != 1 || tally.Yes != 0 {
+		t.Errorf("tally after changing the vote %+v", tally)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// delegationScopeKey returns the Redis key holding the delegations of the requested scope
+func delegationScopeKey(req DelegationRequest) (string, bool) {
+	switch {
+	case req.SessionID != "" && req.Workspace == "":
+		return sessionDelegationsKey(req.SessionID), true
+	case req.Workspace != "" && req.SessionID == "":
+		return workspaceDelegationsKey(req.Workspace), true
+	default:
+		return "", false
+	}
+}
+
+// effectiveDelegations merges workspace delegations with session delegations,
+// a per-session delegation overriding the delegator's workspace-wide one
+func effectiveDelegations(session *VotingSession) (map[string]string, error) {
+	delegations := make(map[string]string)
+	if session.Workspace != "" {
+		workspace, err := getDelegations(workspaceDelegationsKey(session.Workspace))
+		if err != nil {
+			return nil, err
+		}
+		for from, to := range workspace {
+			delegations[from] = to
+		}
+	}
+
+	perSession, err := getDelegations(sessionDelegationsKey(session.Id))
+	if err != nil {
+		return nil, err
+	}
+	for from, to := range perSession {
+		delegations[from] = to
+	}
+	return delegations, nil
+}
+
+// resolveDelegate follows the delegation chain from a user until it reaches someone who voted directly.
+// It returns false when the chain ends without a direct voter or loops back on itself.
+func resolveDelegate(from string, delegations map[string]string, direct map[string]bool) (string, bool) {
+	visited := map[string]bool{from: true}
+	current := from
+	for {
+		next, ok := delegations[current]
+		if !ok {
+			return "", false
+		}
+		if direct[next] {
+			return next, true
+		}
+		if visited[next] {
+			log.Printf("Delegation cycle detected starting at %s", from)
+			return "", false
+		}
+		visited[next] = true
+		current = next
+	}
+}
+
+// createsCycle reports whether delegating from one user to another would loop back to the delegator
+func createsCycle(from string, to string, delegations map[string]string) bool {
+	visited := map[string]bool{}
+	for current := to; current != ""; current = delegations[current] {
+		if current == from {
+			return true
+		}
+		if visited[current] {
+			return false
+		}
+		visited[current] = true
+	}
+	return false
+}
+
+// handleDelegations adds, removes or lists vote delegations for the authorised user
+func handleDelegations(w http.ResponseWriter, r *http.Request) {
+	username, isAuthorised := isAuthorised(w, r)
+	if !isAuthorised {
+		return
+	}
+
+	var req DelegationRequest
+	if r.Method == http.MethodGet {
+		req.SessionID = r.URL.Query().Get("sessionId")
+		req.Workspace = r.URL.Query().Get("workspace")
+	} else {
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("Error decoding JSON: %v", err)
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	key, ok := delegationScopeKey(req)
+	if !ok {
+		sendError(w, "Exactly one of sessionId or workspace is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		delegations, err := getDelegations(key)
+		if err != nil {
+			sendError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		SendResponse(w, http.StatusOK, delegations)
+	case http.MethodPost:
+		createDelegationHandler(w, username, key, req)
+	case http.MethodDelete:
+		if err := removeDelegation(key, username); err != nil {
+			sendError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		touchDelegatedSessions(req)
+		broadcastDelegationChange(req)
+		SendResponse(w, http.StatusOK, map[string]string{"message": "Delegation removed"})
+	default:
+		sendError(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// createDelegationHandler stores a delegation after rejecting self-delegation and cycles
+func createDelegationHandler(w http.ResponseWriter, username string, key string, req DelegationRequest) {
+	if req.Delegate == "" || req.Delegate == username {
+		sendError(w, "A delegate other than yourself is required", http.StatusBadRequest)
+		return
+	}
+
+	var cycle bool
+	if req.SessionID != "" {
+		session, err := getSession(req.SessionID)
+		if err != nil {
+			sendError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		delegations, err := effectiveDelegations(session)
+		if err != nil {
+			sendError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cycle = createsCycle(username, req.Delegate, delegations)
+	} else {
+		var err error
+		if cycle, err = createsWorkspaceCycle(req.Workspace, username, req.Delegate); err != nil {
+			sendError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if cycle {
+		sendError(w, "Delegation would create a cycle", http.StatusConflict)
+		return
+	}
+
+	if err := setDelegation(key, username, req.Delegate); err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%s delegated to %s (%s)", username, req.Delegate, key)
+	touchDelegatedSessions(req)
+	broadcastDelegationChange(req)
+	SendResponse(w, http.StatusOK, map[string]string{"message": "Delegation saved"})
+}
+
+// createsWorkspaceCycle reports whether a workspace delegation would loop back to the delegator, through the other
+// workspace delegations or through the per-session delegations of an open session of the workspace. Sessions where
+// the delegator has a per-session delegation are skipped, as it overrides the workspace one there.
+func createsWorkspaceCycle(workspace string, from string, to string) (bool, error) {
+	delegations, err := getDelegations(workspaceDelegationsKey(workspace))
+	if err != nil {
+		return false, err
+	}
+	if createsCycle(from, to, delegations) {
+		return true, nil
+	}
+
+	sessions, err := delegatedSessions(DelegationRequest{Workspace: workspace})
+	if err != nil {
+		return false, err
+	}
+	for _, session := range sessions {
+		perSession, err := getDelegations(sessionDelegationsKey(session.Id))
+		if err != nil {
+			return false, err
+		}
+		if _, overridden := perSession[from]; overridden {
+			continue
+		}
+		effective, err := effectiveDelegations(session)
+		if err != nil {
+			return false, err
+		}
+		if createsCycle(from, to, effective) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// broadcastDelegationChange pushes the new tally of every open session a delegation change counts in to clients
+func broadcastDelegationChange(req DelegationRequest) {
+	sessions, err := delegatedSessions(req)
+	if err != nil {
+		log.Printf("Error loading sessions for broadcast: %v", err)
+		return
+	}
+	for _, session := range sessions {
+		broadcastSessionStatus(eventSessionUpdated, session)
+	}
+}
+
+// delegatedSessions loads the open sessions whose tally counts the delegations of the request's scope:
+// the session itself, or every session of the workspace
+func delegatedSessions(req DelegationRequest) ([]*VotingSession, error) {
+	ids := []string{req.SessionID}
+	if req.SessionID == "" {
+		var err error
+		if ids, err = getWorkspaceSessionIDs(req.Workspace); err != nil {
+			return nil, err
+		}
+	}
+	var open []*VotingSession
+	for _, id := range ids {
+		session, err := getSession(id)
+		if err == errSessionNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !session.Closed {
+			open = append(open, session)
+		}
+	}
+	return open, nil
+}
+
+// touchDelegatedSessions bumps the version of the open sessions a delegation change counts in, so their ETag
+// changes with the delegated tally and polling clients are not answered 304 with a stale one. A session written
+// by someone else meanwhile already has a new version and is left as it is.
+func touchDelegatedSessions(req DelegationRequest) {
+	sessions, err := delegatedSessions(req)
+	if err != nil {
+		log.Printf("Error loading delegated sessions: %v", err)
+		return
+	}
+	for _, session := range sessions {
+		if err := setSessionIfVersion(session, session.Version); err != nil && err != errVersionConflict {
+			log.Printf("Error bumping the version of session %s: %v", session.Id, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// delegate stores a delegation of the user for a session or workspace scope given as JSON fields
+func delegate(t *testing.T, user string, scope string, want int) {
+	t.Helper()
+	resp, data := apiRequest(t, http.MethodPost, "/v1/delegations", user, nil, `{`+scope+`}`)
+	expectStatus(t, resp, data, want)
+}
+
+// getTestTally returns the tally of a session over REST
+func getTestTally(t *testing.T, id string) Tally {
+	t.Helper()
+	resp, data := apiRequest(t, http.MethodGet, "/v1/sessions/"+id, "alice", nil, "")
+	expectStatus(t, resp, data, http.StatusOK)
+	var session struct {
+		Tally Tally `json:"tally"`
+	}
+	if err := json.Unmarshal(data, &session); err != nil {
+		t.Fatal(err)
+	}
+	return session.Tally
+}
+
+func TestWorkspaceDelegationCyclesThroughSessions(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"mixed cycle","workspace":"cycles"}`)
+	delegate(t, "bob", `"delegate":"carol","sessionId":"`+id+`"`, http.StatusOK)
+	delegate(t, "carol", `"delegate":"bob","workspace":"cycles"`, http.StatusConflict)
+
+	// a per-session delegation of the delegator overrides the workspace one, so it cannot loop there
+	delegate(t, "carol", `"delegate":"dave","sessionId":"`+id+`"`, http.StatusOK)
+	delegate(t, "carol", `"delegate":"bob","workspace":"cycles"`, http.StatusOK)
+}
+
+func TestWorkspaceDelegationUpdatesSessions(t *testing.T) {
+	first := createTestSession(t, "alice", `{"name":"first","workspace":"fanout"}`)
+	second := createTestSession(t, "alice", `{"name":"second","workspace":"fanout"}`)
+	castTestVote(t, "bob", first)
+	castTestVote(t, "bob", second)
+
+	client := newClient(nil, "watcher", "")
+	hub.register(client)
+	defer hub.unregister(client)
+	hub.subscribe(client, ClientMessage{Workspace: "fanout"})
+
+	delegate(t, "carol", `"delegate":"bob","workspace":"fanout"`, http.StatusOK)
+	updated := map[string]float64{}
+	for timeout := time.After(5 * time.Second); len(updated) < 2; {
+		select {
+		case data := <-client.send:
+			var event struct {
+				Type    string      `json:"type"`
+				Payload SessionView `json:"payload"`
+			}
+			if err := json.Unmarshal(data, &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.Type == eventSessionUpdated {
+				updated[event.Payload.Id] = event.Payload.Tally.Yes
+			}
+		case <-timeout:
+			t.Fatalf("session.updated received for %v only", updated)
+		}
+	}
+	if updated[first] != 2 || updated[second] != 2 {
+		t.Errorf("updated tallies %v", updated)
+	}
+}
+
+func TestDelegationFlowsTransitively(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"transitive"}`)
+	castTestVote(t, "bob", id)
+	delegate(t, "carol", `"delegate":"dave","sessionId":"`+id+`"`, http.StatusOK)
+	delegate(t, "dave", `"delegate":"bob","sessionId":"`+id+`"`, http.StatusOK)
+
+	tally := getTestTally(t, id)
+	if tally.Yes != 3 || tally.DirectYes != 1 || tally.DelegatedYes != 2 || tally.Delegations["bob"] != 2 {
+		t.Errorf("transitive tally %+v", tally)
+	}
+
+	// voting directly overrides the voter's own delegation but still carries the ones made to them
+	resp, data := apiRequest(t, http.MethodPatch, "/v1/sessions", "dave", nil, `{"id":"`+id+`","vote":false}`)
+	expectStatus(t, resp, data, http.StatusOK)
+	tally = getTestTally(t, id)
+	if tally.Yes != 1 || tally.No != 2 || tally.DelegatedNo != 1 || tally.Delegations["dave"] != 1 || tally.Delegations["bob"] != 0 {
+		t.Errorf("tally after a direct vote %+v", tally)
+	}
+}
+
+func TestDelegationRejectsCycles(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"cycles"}`)
+	delegate(t, "bob", `"delegate":"bob","sessionId":"`+id+`"`, http.StatusBadRequest)
+	delegate(t, "bob", `"delegate":"carol","sessionId":"`+id+`"`, http.StatusOK)
+	delegate(t, "carol", `"delegate":"dave","sessionId":"`+id+`"`, http.StatusOK)
+	delegate(t, "dave", `"delegate":"bob","sessionId":"`+id+`"`, http.StatusConflict)
+
+	delegate(t, "bob", `"delegate":"carol","workspace":"loops"`, http.StatusOK)
+	delegate(t, "carol", `"delegate":"bob","workspace":"loops"`, http.StatusConflict)
+	delegate(t, "carol", `"delegate":"bob","sessionId":"`+id+`","workspace":"loops"`, http.StatusBadRequest)
+}
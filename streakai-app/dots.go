@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// castDotVote replaces the user's distribution of dots across the session's options
+func castDotVote(session *VotingSession, username string, distribution map[string]int) (*Ballot, error) {
+	if len(distribution) == 0 {
+		return nil, &statusError{status: http.StatusBadRequest, message: "A distribution of dots per option is required"}
+	}
+
+	placed := 0
+	for option, dots := range distribution {
+		if !hasOption(session, option) {
+			return nil, &statusError{status: http.StatusBadRequest, message: "Unknown option " + option}
+		}
+		if dots < 0 {
+			return nil, &statusError{status: http.StatusBadRequest, message: "Dots must not be negative"}
+		}
+		// compared before adding so the running sum never overflows
+		if dots > session.Dots-placed {
+			return nil, &statusError{status: http.StatusUnprocessableEntity,
+				message: fmt.Sprintf("Distribution places more than the %d dots available", session.Dots)}
+		}
+		placed += dots
+	}
+	if placed == 0 {
+		return nil, &statusError{status: http.StatusBadRequest, message: "At least one dot must be placed"}
+	}
+
+	ballot, err := nextBallot(session, username, false, distribution)
+	if err != nil {
+		return nil, err
+	}
+	if session.Allocations == nil {
+		session.Allocations = make(map[string]map[string]int)
+	}
+	session.Allocations[username] = distribution
+	return ballot, nil
+}
+
+// rankOptions orders every option of the session by its total, tied options sharing a rank
+func rankOptions(session *VotingSession, totals map[string]float64) []RankedOption {
+	ranking := make([]RankedOption, 0, len(session.Options))
+	for _, option := range session.Options {
+		ranking = append(ranking, RankedOption{Option: option, Total: totals[option]})
+	}
+	sort.SliceStable(ranking, func(i, j int) bool {
+		return ranking[i].Total > ranking[j].Total
+	})
+
+	for i := range ranking {
+		if i > 0 && ranking[i].Total == ranking[i-1].Total {
+			ranking[i].Rank = ranking[i-1].Rank
+		} else {
+			ranking[i].Rank = i + 1
+		}
+	}
+	return ranking
+}
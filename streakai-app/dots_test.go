@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDotBudgetAndRanking(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"retro","mode":"dots","options":["process","tools","docs"],"dots":3}`)
+	allocate(t, "bob", id, `{"tools":2,"docs":2}`, http.StatusUnprocessableEntity)
+	allocate(t, "bob", id, `{"tools":0}`, http.StatusBadRequest)
+	allocate(t, "bob", id, `{"tools":2,"docs":1}`, http.StatusOK)
+	// a new distribution replaces the earlier one instead of adding to it
+	allocate(t, "carol", id, `{"process":3}`, http.StatusOK)
+	allocate(t, "carol", id, `{"process":1,"tools":2}`, http.StatusOK)
+
+	resp, data := apiRequest(t, http.MethodGet, "/v1/sessions/"+id, "alice", nil, "")
+	expectStatus(t, resp, data, http.StatusOK)
+	var session struct {
+		Ranking []RankedOption `json:"ranking"`
+	}
+	if err := json.Unmarshal(data, &session); err != nil {
+		t.Fatal(err)
+	}
+	want := []RankedOption{{Rank: 1, Option: "tools", Total: 4}, {Rank: 2, Option: "process", Total: 1}, {Rank: 2, Option: "docs", Total: 1}}
+	if !reflect.DeepEqual(session.Ranking, want) {
+		t.Errorf("ranking %+v, want %+v", session.Ranking, want)
+	}
+}
+
+func TestDotBudgetDoesNotOverflow(t *testing.T) {
+	session := &VotingSession{Mode: modeDots, Options: []string{"a", "b"}, Dots: 3}
+	// the sum of both counts wraps around to 2
+	if _, err := castDotVote(session, "bob", map[string]int{"a": math.MaxInt64, "b": math.MinInt64 + 3}); err == nil {
+		t.Errorf("an overflowing distribution was accepted")
+	}
+	if _, err := castDotVote(session, "bob", map[string]int{"a": math.MaxInt64, "b": 3}); err == nil || err.(*statusError).status != http.StatusUnprocessableEntity {
+		t.Errorf("a huge distribution was accepted: %v", err)
+	}
+}
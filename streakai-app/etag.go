@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// anyVersion lets a conditional update apply to whichever version is stored
+const anyVersion int64 = -1
+
+// errVersionConflict reports a session that changed since the version an update was based on
+var errVersionConflict = &statusError{status: http.StatusPreconditionFailed, message: "Session was modified, fetch it again and retry"}
+
+// sessionETag returns the strong ETag of a session version
+func sessionETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// parseIfMatch returns the version an If-Match header refers to, * matching any version
+func parseIfMatch(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "*" {
+		return anyVersion, nil
+	}
+	version, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+	if err != nil || version < 0 {
+		return 0, &statusError{status: http.StatusPreconditionFailed, message: "If-Match must be the ETag of the session"}
+	}
+	return version, nil
+}
+
+// etagMatches reports whether an If-None-Match header lists the ETag, comparing weakly
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
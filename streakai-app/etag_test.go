@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestDelegationChangesETag checks a poll after a delegation change gets the new delegated tally instead of a 304
+func TestDelegationChangesETag(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"delegated etag","workspace":"etag"}`)
+	castTestVote(t, "bob", id)
+	poll := func(etag string) string {
+		t.Helper()
+		resp, data := apiRequest(t, http.MethodGet, "/v1/sessions/"+id, "alice", map[string]string{"If-None-Match": etag}, "")
+		if resp.StatusCode == http.StatusNotModified {
+			return etag
+		}
+		expectStatus(t, resp, data, http.StatusOK)
+		return resp.Header.Get("ETag")
+	}
+	etag := poll(`"0"`)
+	if poll(etag) != etag {
+		t.Fatalf("an unchanged session was not answered 304")
+	}
+
+	for _, change := range []struct{ method, body string }{
+		{http.MethodPost, `{"delegate":"bob","sessionId":"` + id + `"}`},
+		{http.MethodDelete, `{"sessionId":"` + id + `"}`},
+		{http.MethodPost, `{"delegate":"bob","workspace":"etag"}`},
+		{http.MethodDelete, `{"workspace":"etag"}`},
+	} {
+		resp, data := apiRequest(t, change.method, "/v1/delegations", "carol", nil, change.body)
+		expectStatus(t, resp, data, http.StatusOK)
+		next := poll(etag)
+		if next == etag {
+			t.Errorf("%s %s left the ETag at %s", change.method, change.body, etag)
+		}
+		etag = next
+	}
+}
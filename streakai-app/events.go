@@ -0,0 +1,88 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// eventVersion is bumped whenever the envelope or a payload changes incompatibly
+const eventVersion = 1
+
+// Event types pushed to real-time clients
+const (
+	eventSessionCreated  = "session.created"
+	eventSessionUpdated  = "session.updated"
+	eventSessionClosed   = "session.closed"
+	eventSessionSnapshot = "session.snapshot"
+	eventVoteCast        = "vote.cast"
+	eventPresenceChanged = "presence.changed"
+	eventSessionQuorum   = "session.quorum"
+	// eventSessionDeleted tells subscribers a session no longer exists, its payload is the session ID
+	eventSessionDeleted = "session.deleted"
+)
+
+//go:embed schema/events.schema.json
+var eventSchema []byte
+
+// newSessionEvent wraps the current view of a session in a versioned envelope.
+// Snapshots reuse the latest sequence number, every other event takes the next one.
+func newSessionEvent(eventType string, session *VotingSession) (*Event, error) {
+	view, err := sessionView(session)
+	if err != nil {
+		return nil, err
+	}
+
+	var seq int64
+	if eventType == eventSessionSnapshot {
+		seq, err = currentEventSeq(session.Id)
+	} else {
+		seq, err = nextEventSeq(session.Id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Event{
+		Version:   eventVersion,
+		Type:      eventType,
+		SessionID: session.Id,
+		Seq:       seq,
+		Timestamp: time.Now().UTC(),
+		Payload:   view,
+	}, nil
+}
+
+// rawEvent is an encoded event envelope whose payload is left undecoded
+type rawEvent struct {
+	Event
+	Payload json.RawMessage `json:"payload"`
+}
+
+// decodeEvent reads the envelope of an encoded event
+func decodeEvent(data []byte) (*rawEvent, error) {
+	var event rawEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// carriesSession reports whether the payload of an event type is the session view
+func carriesSession(eventType string) bool {
+	switch eventType {
+	case eventSessionCreated, eventSessionUpdated, eventSessionClosed, eventSessionSnapshot, eventSessionQuorum, eventVoteCast:
+		return true
+	}
+	return false
+}
+
+// handleEventSchema publishes the JSON schema of the real-time event envelope
+func handleEventSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	if _, err := w.Write(eventSchema); err != nil {
+		log.Printf("Error writing event schema: %v", err)
+	}
+}
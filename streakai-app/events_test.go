@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// schemaValidator checks documents against the subset of JSON Schema that events.schema.json uses
+type schemaValidator struct {
+	root map[string]interface{}
+}
+
+func (v schemaValidator) validate(schema interface{}, value interface{}, path string) []string {
+	if allowed, ok := schema.(bool); ok {
+		if !allowed {
+			return []string{path + ": not allowed"}
+		}
+		return nil
+	}
+	s := schema.(map[string]interface{})
+	if ref, ok := s["$ref"].(string); ok {
+		def := v.root["$defs"].(map[string]interface{})[strings.TrimPrefix(ref, "#/$defs/")]
+		return v.validate(def, value, path)
+	}
+
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, path+": "+fmt.Sprintf(format, args...))
+	}
+	if types, ok := s["type"]; ok && !hasSchemaType(types, value) {
+		fail("%v is not of type %v", value, types)
+		return problems
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, value) {
+		fail("%v is not %v", value, c)
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || reflect.DeepEqual(e, value)
+		}
+		if !found {
+			fail("%v is not one of %v", value, enum)
+		}
+	}
+	if minimum, ok := s["minimum"].(float64); ok {
+		if n, isNumber := value.(float64); isNumber && n < minimum {
+			fail("%v is below %v", n, minimum)
+		}
+	}
+	if maxLength, ok := s["maxLength"].(float64); ok {
+		if text, isString := value.(string); isString && float64(len([]rune(text))) > maxLength {
+			fail("longer than %v", maxLength)
+		}
+	}
+
+	if object, ok := value.(map[string]interface{}); ok {
+		for _, name := range asList(s["required"]) {
+			if _, present := object[name.(string)]; !present {
+				fail("%s is required", name)
+			}
+		}
+		properties, _ := s["properties"].(map[string]interface{})
+		for name, field := range object {
+			if property, ok := properties[name]; ok {
+				problems = append(problems, v.validate(property, field, path+"."+name)...)
+			} else if additional, ok := s["additionalProperties"]; ok {
+				problems = append(problems, v.validate(additional, field, path+"."+name)...)
+			}
+		}
+	}
+	if array, ok := value.([]interface{}); ok && s["items"] != nil {
+		for i, item := range array {
+			problems = append(problems, v.validate(s["items"], item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+
+	for _, sub := range asList(s["allOf"]) {
+		problems = append(problems, v.validate(sub, value, path)...)
+	}
+	if oneOf := asList(s["oneOf"]); len(oneOf) > 0 {
+		matched := 0
+		for _, sub := range oneOf {
+			if len(v.validate(sub, value, path)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("matches %d of the oneOf schemas", matched)
+		}
+	}
+	if condition, ok := s["if"]; ok && len(v.validate(condition, value, path)) == 0 {
+		problems = append(problems, v.validate(s["then"], value, path)...)
+	}
+	return problems
+}
+
+func asList(value interface{}) []interface{} {
+	list, _ := value.([]interface{})
+	return list
+}
+
+// hasSchemaType reports whether the decoded JSON value has the schema type, or one of the list of types
+func hasSchemaType(types interface{}, value interface{}) bool {
+	if list, ok := types.([]interface{}); ok {
+		for _, t := range list {
+			if hasSchemaType(t, value) {
+				return true
+			}
+		}
+		return false
+	}
+	switch value := value.(type) {
+	case nil:
+		return types == "null"
+	case bool:
+		return types == "boolean"
+	case string:
+		return types == "string"
+	case float64:
+		return types == "number" || types == "integer" && value == math.Trunc(value)
+	case []interface{}:
+		return types == "array"
+	default:
+		return types == "object"
+	}
+}
+
+func loadEventSchema(t *testing.T) schemaValidator {
+	t.Helper()
+	var root map[string]interface{}
+	if err := json.Unmarshal(eventSchema, &root); err != nil {
+		t.Fatal(err)
+	}
+	return schemaValidator{root: root}
+}
+
+func TestEventsMatchSchema(t *testing.T) {
+	schema := loadEventSchema(t)
+	id := createTestSession(t, "alice", `{"name":"schema","weights":{"bob":2}}`)
+	client := subscribeTestClient(t, "carol", ClientMessage{SessionID: id})
+	castTestVote(t, "bob", id)
+	if err := react("bob", id, "🎉"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := postChatMessage("bob", id, "ship it"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nudgeNonVoters("alice", id); err != nil {
+		t.Fatal(err)
+	}
+	closeTestSession(t, id)
+	client.sendSnapshot(hub, ClientMessage{SessionID: id})
+	resp, data := apiRequest(t, http.MethodPost, "/v1/bulk/sessions/delete", "alice", nil, `{"ids":["`+id+`"]}`)
+	expectStatus(t, resp, data, http.StatusOK)
+
+	seen := map[string]bool{}
+	for timeout := time.After(5 * time.Second); !seen[eventSessionDeleted]; {
+		select {
+		case data := <-client.send:
+			var event map[string]interface{}
+			if err := json.Unmarshal(data, &event); err != nil {
+				t.Fatal(err)
+			}
+			for _, problem := range schema.validate(schema.root, event, "event") {
+				t.Errorf("%s: %s", event["type"], problem)
+			}
+			seen[event["type"].(string)] = true
+		case <-timeout:
+			t.Fatalf("only received %v", seen)
+		}
+	}
+	for _, eventType := range []string{eventPresenceChanged, eventVoteCast, eventReaction, eventChatMessage, eventNudge, eventSessionClosed, eventSessionSnapshot} {
+		if !seen[eventType] {
+			t.Errorf("no %s event was checked", eventType)
+		}
+	}
+}
+
+func TestSchemaRejectsMalformedEvents(t *testing.T) {
+	schema := loadEventSchema(t)
+	valid := `{"v":1,"type":"session.deleted","sessionId":"s","seq":0,"timestamp":"2024-01-01T00:00:00Z","payload":{"id":"s"}}`
+	for _, data := range []string{
+		valid,
+		`{"type":"ack","requestId":"r1","payload":{"sessionID":"s"}}`,
+	} {
+		var document interface{}
+		json.Unmarshal([]byte(data), &document)
+		if problems := schema.validate(schema.root, document, "event"); len(problems) > 0 {
+			t.Errorf("%s was rejected: %v", data, problems)
+		}
+	}
+	for _, data := range []string{
+		strings.Replace(valid, `"v":1`, `"v":2`, 1),
+		strings.Replace(valid, `"seq":0`, `"seq":-1`, 1),
+		strings.Replace(valid, `,"payload":{"id":"s"}`, ``, 1),
+		strings.Replace(valid, `{"id":"s"}`, `{}`, 1),
+		strings.Replace(valid, `session.deleted`, `session.renamed`, 1),
+		`{"v":1,"type":"vote.cast","sessionId":"s","seq":3,"timestamp":"2024-01-01T00:00:00Z","payload":{"id":"s","name":"n"}}`,
+		`{"type":"done","requestId":"r1"}`,
+	} {
+		var document interface{}
+		json.Unmarshal([]byte(data), &document)
+		if problems := schema.validate(schema.root, document, "event"); len(problems) == 0 {
+			t.Errorf("%s was accepted", data)
+		}
+	}
+}
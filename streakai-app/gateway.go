@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	pb "streakai/grpc"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// gateway serves the REST routes transcoded from the http options of voting.proto and user.proto
+var gateway http.Handler
+
+// initGateway registers the VotingService, through its own gRPC listener so calls pass the same
+// interceptors, and the auth StreakAiService, through the existing auth connection
+func initGateway(ctx context.Context) error {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &numberMarshaler{runtime.JSONPb{
+			MarshalOptions:   protojson.MarshalOptions{EmitUnpopulated: true},
+			UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+		}}),
+		runtime.WithErrorHandler(gatewayErrorHandler),
+		runtime.WithIncomingHeaderMatcher(gatewayHeaderMatcher),
+		runtime.WithForwardResponseOption(setSessionETag),
+	)
+	if err := pb.RegisterStreakAiServiceHandlerClient(ctx, mux, grpcClient); err != nil {
+		return err
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if err := pb.RegisterVotingServiceHandlerFromEndpoint(ctx, mux, "localhost"+votingServiceAddr, opts); err != nil {
+		return err
+	}
+	gateway = mux
+	return nil
+}
+
+// numberMarshaler writes the 64-bit integers of gateway responses, such as version and closedAt, as JSON numbers
+// like the events and webhooks do, where the protobuf JSON mapping would write strings. The values it carries,
+// versions and Unix times, stay far below the 2^53 a JSON number holds exactly.
+type numberMarshaler struct {
+	runtime.JSONPb
+}
+
+func (m *numberMarshaler) Marshal(v interface{}) ([]byte, error) {
+	data, err := m.JSONPb.Marshal(v)
+	msg, ok := v.(proto.Message)
+	if err != nil || !ok {
+		return data, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	unquoteInt64s(msg.ProtoReflect().Descriptor(), value)
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// unquoteInt64s turns the quoted 64-bit integers of the JSON form of a message into numbers, following its descriptor
+func unquoteInt64s(desc protoreflect.MessageDescriptor, value interface{}) {
+	object, ok := value.(map[string]interface{})
+	if !ok || desc.FullName().Parent() == "google.protobuf" {
+		return
+	}
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		fieldValue, ok := object[field.JSONName()]
+		if !ok {
+			continue
+		}
+		switch {
+		case field.IsMap():
+			entries, _ := fieldValue.(map[string]interface{})
+			for key, entry := range entries {
+				entries[key] = unquoteInt64(field.MapValue(), entry)
+			}
+		case field.IsList():
+			items, _ := fieldValue.([]interface{})
+			for i, item := range items {
+				items[i] = unquoteInt64(field, item)
+			}
+		default:
+			object[field.JSONName()] = unquoteInt64(field, fieldValue)
+		}
+	}
+}
+
+// unquoteInt64 returns a single value of the field with 64-bit integers unquoted
+func unquoteInt64(field protoreflect.FieldDescriptor, value interface{}) interface{} {
+	switch field.Kind() {
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if quoted, ok := value.(string); ok {
+			return json.Number(quoted)
+		}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		unquoteInt64s(field.Message(), value)
+	}
+	return value
+}
+
+// transcode hands a request to the gateway, whose routes are declared without the /v1 prefix
+func transcode(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, apiVersionPrefix+"/") {
+		r = r.Clone(r.Context())
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, apiVersionPrefix)
+		r.URL.RawPath = ""
+	}
+	gateway.ServeHTTP(w, r)
+}
+
+// gatewayHeaderMatcher forwards If-Match as if-match metadata for the optimistic concurrency checks
+func gatewayHeaderMatcher(key string) (string, bool) {
+	if strings.EqualFold(key, "If-Match") {
+		return "if-match", true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// setSessionETag sends the version of a returned session as its ETag
+func setSessionETag(ctx context.Context, w http.ResponseWriter, msg proto.Message) error {
+	if session, ok := msg.(*pb.Session); ok {
+		w.Header().Set("ETag", sessionETag(session.Version))
+	}
+	return nil
+}
+
+// gatewayErrorHandler reports failed calls with the API's JSON error model
+func gatewayErrorHandler(ctx context.Context, _ *runtime.ServeMux, _ runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	sendError(w, status.Convert(err).Message(), grpcHTTPStatus(err))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	pb "streakai/grpc"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestNumberMarshalerKeepsInt64(t *testing.T) {
+	marshaler := &numberMarshaler{runtime.JSONPb{}}
+	data, err := marshaler.Marshal(&pb.ListSessionsResponse{Sessions: []*pb.Session{{
+		Id:          "1234",
+		Version:     1 << 40,
+		ClosedAt:    1 << 33,
+		Allocations: map[string]*structpb.Struct{"alice": toProtoAllocation(map[string]int{"a": 2})},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response struct {
+		Sessions []map[string]interface{} `json:"sessions"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	session := response.Sessions[0]
+	if session["version"] != json.Number("1099511627776") || session["closedAt"] != json.Number("8589934592") {
+		t.Errorf("64-bit integers were not kept as numbers: %s", data)
+	}
+	if session["id"] != "1234" {
+		t.Errorf("a numeric string was unquoted: %s", data)
+	}
+}
+
+// TestAllocationsMatchEvents checks REST returns allocations in the { user: { option: n } } shape of events
+func TestAllocationsMatchEvents(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"allocations","mode":"quadratic","options":["a","b"],"credits":9}`)
+	resp, data := apiRequest(t, http.MethodPatch, "/v1/sessions", "bob", nil, `{"id":"`+id+`","allocation":{"a":2}}`)
+	expectStatus(t, resp, data, http.StatusOK)
+	resp, data = apiRequest(t, http.MethodGet, "/v1/sessions/"+id, "alice", nil, "")
+	expectStatus(t, resp, data, http.StatusOK)
+
+	var session struct {
+		Allocations map[string]map[string]int `json:"allocations"`
+	}
+	if err := json.Unmarshal(data, &session); err != nil {
+		t.Fatalf("allocations are not { user: { option: n } }: %v", err)
+	}
+	if !reflect.DeepEqual(session.Allocations, map[string]map[string]int{"bob": {"a": 2}}) {
+		t.Errorf("allocations %v", session.Allocations)
+	}
+}
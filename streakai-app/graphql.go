@@ -0,0 +1,830 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// graphQLMaxDepth bounds how deeply a query may nest, sessions link back to users and workspaces
+const graphQLMaxDepth = 8
+
+// graphQLMaxSessions bounds how many sessions one operation may load, as aliases repeat session lists
+const graphQLMaxSessions = 500
+
+type sessionLoadsKey struct{}
+
+// withSessionLoadLimit starts counting the sessions an operation loads against graphQLMaxSessions
+func withSessionLoadLimit(ctx context.Context) context.Context {
+	remaining := int64(graphQLMaxSessions)
+	return context.WithValue(ctx, sessionLoadsKey{}, &remaining)
+}
+
+// chargeSessionLoads counts n sessions against the operation's limit before they are loaded
+func chargeSessionLoads(ctx context.Context, n int) error {
+	remaining, ok := ctx.Value(sessionLoadsKey{}).(*int64)
+	if !ok {
+		return nil
+	}
+	if atomic.AddInt64(remaining, -int64(n)) < 0 {
+		return &graphQLError{
+			message: fmt.Sprintf("The operation loads more than %d sessions, select fewer lists or filter by workspace", graphQLMaxSessions),
+			code:    errorCode(http.StatusUnprocessableEntity),
+		}
+	}
+	return nil
+}
+
+//go:embed schema/schema.graphql
+var graphQLSDL string
+
+var graphQLSchema *graphql.Schema
+
+// initGraphQL parses the GraphQL schema and binds it to its resolvers
+func initGraphQL() error {
+	schema, err := graphql.ParseSchema(graphQLSDL, &graphQLResolver{}, graphql.MaxDepth(graphQLMaxDepth))
+	if err != nil {
+		return err
+	}
+	graphQLSchema = schema
+	return nil
+}
+
+// graphQLRequest is the body of a GraphQL query or mutation
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// handleGraphQL executes POSTed queries and mutations
+func handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	username, isAuthorised := isAuthorised(w, r)
+	if !isAuthorised {
+		return
+	}
+
+	var req graphQLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := withSessionLoadLimit(context.WithValue(r.Context(), usernameKey{}, username))
+	SendResponse(w, http.StatusOK, graphQLSchema.Exec(ctx, req.Query, req.OperationName, req.Variables))
+}
+
+// graphQLError reports a failed resolver with the API error code in its extensions
+type graphQLError struct {
+	message string
+	code    string
+}
+
+func (e *graphQLError) Error() string {
+	return e.message
+}
+
+func (e *graphQLError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+// toGraphQLError carries the status of a statusError over as the error's code
+func toGraphQLError(err error) error {
+	if se, ok := err.(*statusError); ok {
+		return &graphQLError{message: se.message, code: errorCode(se.status)}
+	}
+	return &graphQLError{message: err.Error(), code: errorCode(http.StatusInternalServerError)}
+}
+
+// graphQLResolver resolves the root query, mutation and subscription fields
+type graphQLResolver struct{}
+
+func (r *graphQLResolver) Me(ctx context.Context) *userResolver {
+	return &userResolver{username: callerName(ctx)}
+}
+
+func (r *graphQLResolver) Session(ctx context.Context, args struct{ ID graphql.ID }) (*sessionResolver, error) {
+	if err := chargeSessionLoads(ctx, 1); err != nil {
+		return nil, err
+	}
+	session, err := getSession(string(args.ID))
+	if err == errSessionNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return newSessionResolver(session)
+}
+
+func (r *graphQLResolver) Sessions(ctx context.Context, args struct{ Workspace *string }) ([]*sessionResolver, error) {
+	var ids []string
+	var err error
+	if args.Workspace != nil {
+		ids, err = getWorkspaceSessionIDs(*args.Workspace)
+	} else {
+		ids, err = getAllSessionIDs()
+	}
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return loadSessionResolvers(ctx, ids)
+}
+
+func (r *graphQLResolver) User(args struct{ Username string }) *userResolver {
+	return &userResolver{username: args.Username}
+}
+
+func (r *graphQLResolver) Workspace(args struct{ Name string }) *workspaceResolver {
+	return &workspaceResolver{name: args.Name}
+}
+
+type weightInput struct {
+	User   string
+	Weight float64
+}
+
+type optionVotesInput struct {
+	Option string
+	Votes  int32
+}
+
+func (r *graphQLResolver) CreateSession(ctx context.Context, args struct {
+	Input struct {
+		Name      string
+		Workspace *string
+		Mode      *string
+		Options   *[]string
+		Credits   *int32
+		Dots      *int32
+		Weights   *[]weightInput
+		Quorum    *int32
+	}
+}) (*sessionResolver, error) {
+	input := args.Input
+	session := &VotingSession{Name: input.Name}
+	if input.Workspace != nil {
+		session.Workspace = *input.Workspace
+	}
+	if input.Mode != nil {
+		session.Mode = *input.Mode
+	}
+	if input.Options != nil {
+		session.Options = *input.Options
+	}
+	if input.Credits != nil {
+		session.Credits = int(*input.Credits)
+	}
+	if input.Dots != nil {
+		session.Dots = int(*input.Dots)
+	}
+	if input.Quorum != nil {
+		session.Quorum = int(*input.Quorum)
+	}
+	if input.Weights != nil {
+		session.Weights = make(map[string]float64, len(*input.Weights))
+		for _, weight := range *input.Weights {
+			session.Weights[weight.User] = weight.Weight
+		}
+	}
+
+	if err := createSession(callerName(ctx), session); err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return newSessionResolver(session)
+}
+
+func (r *graphQLResolver) CastVote(ctx context.Context, args struct {
+	Input struct {
+		SessionID  graphql.ID
+		Vote       *bool
+		Change     *bool
+		Allocation *[]optionVotesInput
+	}
+}) (*voteReceiptResolver, error) {
+	input := args.Input
+	vote := SingleVote{Id: string(input.SessionID)}
+	if input.Vote != nil {
+		vote.Vote = *input.Vote
+	}
+	if input.Change != nil {
+		vote.Change = *input.Change
+	}
+	if input.Allocation != nil {
+		vote.Allocation = make(map[string]int, len(*input.Allocation))
+		for _, votes := range *input.Allocation {
+			vote.Allocation[votes.Option] = int(votes.Votes)
+		}
+	}
+
+	ballot, err := recordVote(callerName(ctx), vote)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return &voteReceiptResolver{VoteReceipt{SessionID: vote.Id, Seq: ballot.Seq, Voter: ballot.Voter, Hash: ballot.Hash}}, nil
+}
+
+func (r *graphQLResolver) SessionEvents(ctx context.Context, args struct {
+	SessionID  graphql.ID
+	ResumeFrom *int32
+}) (<-chan *sessionEventResolver, error) {
+	session, err := getSession(string(args.SessionID))
+	if err != nil {
+		return nil, toGraphQLError(&statusError{status: http.StatusNotFound, message: err.Error()})
+	}
+
+	client := newClient(nil, callerName(ctx), "")
+	hub.register(client)
+	hub.subscribe(client, ClientMessage{SessionID: session.Id})
+
+	var after *int64
+	if args.ResumeFrom != nil {
+		seq := int64(*args.ResumeFrom)
+		after = &seq
+	}
+	initial, err := initialEvents(session, after)
+	if err != nil {
+		hub.unregister(client)
+		return nil, toGraphQLError(err)
+	}
+	return streamEvents(ctx, client, initial), nil
+}
+
+func (r *graphQLResolver) WorkspaceEvents(ctx context.Context, args struct{ Workspace string }) <-chan *sessionEventResolver {
+	client := newClient(nil, callerName(ctx), "")
+	hub.register(client)
+	hub.subscribe(client, ClientMessage{Workspace: args.Workspace})
+	return streamEvents(ctx, client, nil)
+}
+
+// streamEvents feeds the initial events, then the events the hub pushes to the client, to a subscription
+// until it is cancelled or the client falls too far behind
+func streamEvents(ctx context.Context, client *Client, initial []json.RawMessage) <-chan *sessionEventResolver {
+	events := make(chan *sessionEventResolver)
+	go func() {
+		defer close(events)
+		defer hub.unregister(client)
+
+		send := func(data []byte) bool {
+			event, err := newSessionEventResolver(data)
+			if err != nil {
+				log.Printf("Error decoding event for GraphQL subscription: %v", err)
+				return true
+			}
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for _, data := range initial {
+			if !send(data) {
+				return
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case data, ok := <-client.send:
+				if !ok || !send(data) {
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
+
+// loadSessionResolvers loads the sessions with the given IDs, skipping those removed meanwhile
+func loadSessionResolvers(ctx context.Context, ids []string) ([]*sessionResolver, error) {
+	if err := chargeSessionLoads(ctx, len(ids)); err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	resolvers := make([]*sessionResolver, 0, len(ids))
+	for _, id := range ids {
+		session, err := getSession(id)
+		if err != nil {
+			log.Printf("Error loading session %s: %v", id, err)
+			continue
+		}
+		resolver, err := newSessionResolver(session)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, resolver)
+	}
+	return resolvers, nil
+}
+
+type userResolver struct {
+	username string
+}
+
+func (r *userResolver) Username() string {
+	return r.username
+}
+
+func (r *userResolver) OwnedSessions(ctx context.Context) ([]*sessionResolver, error) {
+	ids, err := getUserSessionIDs(ownedSessionsKey(r.username))
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return loadSessionResolvers(ctx, ids)
+}
+
+func (r *userResolver) VotedSessions(ctx context.Context) ([]*sessionResolver, error) {
+	ids, err := getUserSessionIDs(votedSessionsKey(r.username))
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return loadSessionResolvers(ctx, ids)
+}
+
+type workspaceResolver struct {
+	name string
+}
+
+func (r *workspaceResolver) Name() string {
+	return r.name
+}
+
+func (r *workspaceResolver) Sessions(ctx context.Context) ([]*sessionResolver, error) {
+	ids, err := getWorkspaceSessionIDs(r.name)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return loadSessionResolvers(ctx, ids)
+}
+
+func (r *workspaceResolver) Delegations() ([]*delegationResolver, error) {
+	delegations, err := getDelegations(workspaceDelegationsKey(r.name))
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return delegationResolvers(delegations), nil
+}
+
+// sessionResolver resolves a session from its view, so sessions read from Redis and from events resolve alike
+type sessionResolver struct {
+	view *SessionView
+}
+
+func newSessionResolver(session *VotingSession) (*sessionResolver, error) {
+	view, err := sessionView(session)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return &sessionResolver{view: view}, nil
+}
+
+func (r *sessionResolver) ID() graphql.ID {
+	return graphql.ID(r.view.Id)
+}
+
+func (r *sessionResolver) Name() string {
+	return r.view.Name
+}
+
+func (r *sessionResolver) Owner() string {
+	return r.view.Owner
+}
+
+func (r *sessionResolver) Workspace() *string {
+	if r.view.Workspace == "" {
+		return nil
+	}
+	return &r.view.Workspace
+}
+
+func (r *sessionResolver) Mode() string {
+	return r.view.Mode
+}
+
+func (r *sessionResolver) Options() []string {
+	return nonNil(r.view.Options)
+}
+
+func (r *sessionResolver) Credits() int32 {
+	return int32(r.view.Credits)
+}
+
+func (r *sessionResolver) Dots() int32 {
+	return int32(r.view.Dots)
+}
+
+func (r *sessionResolver) Quorum() int32 {
+	return int32(r.view.Quorum)
+}
+
+func (r *sessionResolver) Version() int32 {
+	return int32(r.view.Version)
+}
+
+func (r *sessionResolver) YesVoters() []string {
+	return nonNil(r.view.YesCount)
+}
+
+func (r *sessionResolver) NoVoters() []string {
+	return nonNil(r.view.NoCount)
+}
+
+func (r *sessionResolver) Allocations() []*allocationResolver {
+	allocations := make([]*allocationResolver, 0, len(r.view.Allocations))
+	for _, user := range sortedKeys(r.view.Allocations) {
+		allocations = append(allocations, &allocationResolver{user: user, votes: r.view.Allocations[user]})
+	}
+	return allocations
+}
+
+func (r *sessionResolver) Weights() []*weightResolver {
+	return weightResolvers(r.view.Weights)
+}
+
+func (r *sessionResolver) BallotHead() string {
+	return r.view.BallotHead
+}
+
+func (r *sessionResolver) Closed() bool {
+	return r.view.Closed
+}
+
+func (r *sessionResolver) Archived() bool {
+	return r.view.Archived
+}
+
+func (r *sessionResolver) ClosedAt() *string {
+	if !r.view.Closed {
+		return nil
+	}
+	closedAt := formatUnix(r.view.ClosedAt)
+	return &closedAt
+}
+
+func (r *sessionResolver) Result() *tallyResolver {
+	if r.view.Result == nil {
+		return nil
+	}
+	return &tallyResolver{r.view.Result}
+}
+
+func (r *sessionResolver) Tally() *tallyResolver {
+	return &tallyResolver{&r.view.Tally}
+}
+
+func (r *sessionResolver) RemainingCredits() []*creditsResolver {
+	credits := make([]*creditsResolver, 0, len(r.view.RemainingCredits))
+	for _, user := range sortedKeys(r.view.RemainingCredits) {
+		credits = append(credits, &creditsResolver{user: user, credits: r.view.RemainingCredits[user]})
+	}
+	return credits
+}
+
+func (r *sessionResolver) Ranking() []*rankedOptionResolver {
+	ranking := make([]*rankedOptionResolver, 0, len(r.view.Ranking))
+	for _, ranked := range r.view.Ranking {
+		ranking = append(ranking, &rankedOptionResolver{ranked})
+	}
+	return ranking
+}
+
+func (r *sessionResolver) Presence() *presenceResolver {
+	if r.view.Presence == nil {
+		return nil
+	}
+	return &presenceResolver{r.view.Presence}
+}
+
+func (r *sessionResolver) Ballots() ([]*ballotResolver, error) {
+	ballots, err := getBallots(r.view.Id)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	resolvers := make([]*ballotResolver, 0, len(ballots))
+	for _, ballot := range ballots {
+		resolvers = append(resolvers, &ballotResolver{ballot})
+	}
+	return resolvers, nil
+}
+
+func (r *sessionResolver) Delegations() ([]*delegationResolver, error) {
+	delegations, err := effectiveDelegations(r.view.VotingSession)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return delegationResolvers(delegations), nil
+}
+
+type allocationResolver struct {
+	user  string
+	votes map[string]int
+}
+
+func (r *allocationResolver) User() string {
+	return r.user
+}
+
+func (r *allocationResolver) Votes() []*optionVotesResolver {
+	return optionVotesResolvers(r.votes)
+}
+
+type optionVotesResolver struct {
+	option string
+	votes  int
+}
+
+func (r *optionVotesResolver) Option() string {
+	return r.option
+}
+
+func (r *optionVotesResolver) Votes() int32 {
+	return int32(r.votes)
+}
+
+func optionVotesResolvers(votes map[string]int) []*optionVotesResolver {
+	resolvers := make([]*optionVotesResolver, 0, len(votes))
+	for _, option := range sortedKeys(votes) {
+		resolvers = append(resolvers, &optionVotesResolver{option: option, votes: votes[option]})
+	}
+	return resolvers
+}
+
+type weightResolver struct {
+	user   string
+	weight float64
+}
+
+func (r *weightResolver) User() string {
+	return r.user
+}
+
+func (r *weightResolver) Weight() float64 {
+	return r.weight
+}
+
+func weightResolvers(weights map[string]float64) []*weightResolver {
+	resolvers := make([]*weightResolver, 0, len(weights))
+	for _, user := range sortedKeys(weights) {
+		resolvers = append(resolvers, &weightResolver{user: user, weight: weights[user]})
+	}
+	return resolvers
+}
+
+type creditsResolver struct {
+	user    string
+	credits int
+}
+
+func (r *creditsResolver) User() string {
+	return r.user
+}
+
+func (r *creditsResolver) Credits() int32 {
+	return int32(r.credits)
+}
+
+type optionTotalResolver struct {
+	option string
+	total  float64
+}
+
+func (r *optionTotalResolver) Option() string {
+	return r.option
+}
+
+func (r *optionTotalResolver) Total() float64 {
+	return r.total
+}
+
+type tallyResolver struct {
+	tally *Tally
+}
+
+func (r *tallyResolver) Yes() float64 {
+	return r.tally.Yes
+}
+
+func (r *tallyResolver) No() float64 {
+	return r.tally.No
+}
+
+func (r *tallyResolver) DirectYes() float64 {
+	return r.tally.DirectYes
+}
+
+func (r *tallyResolver) DirectNo() float64 {
+	return r.tally.DirectNo
+}
+
+func (r *tallyResolver) DelegatedYes() float64 {
+	return r.tally.DelegatedYes
+}
+
+func (r *tallyResolver) DelegatedNo() float64 {
+	return r.tally.DelegatedNo
+}
+
+func (r *tallyResolver) Delegations() []*weightResolver {
+	return weightResolvers(r.tally.Delegations)
+}
+
+func (r *tallyResolver) Weights() []*weightResolver {
+	return weightResolvers(r.tally.Weights)
+}
+
+func (r *tallyResolver) Options() []*optionTotalResolver {
+	options := make([]*optionTotalResolver, 0, len(r.tally.Options))
+	for _, option := range sortedKeys(r.tally.Options) {
+		options = append(options, &optionTotalResolver{option: option, total: r.tally.Options[option]})
+	}
+	return options
+}
+
+type rankedOptionResolver struct {
+	ranked RankedOption
+}
+
+func (r *rankedOptionResolver) Rank() int32 {
+	return int32(r.ranked.Rank)
+}
+
+func (r *rankedOptionResolver) Option() string {
+	return r.ranked.Option
+}
+
+func (r *rankedOptionResolver) Total() float64 {
+	return r.ranked.Total
+}
+
+type presenceResolver struct {
+	presence *Presence
+}
+
+func (r *presenceResolver) Present() []string {
+	return nonNil(r.presence.Present)
+}
+
+func (r *presenceResolver) NotVoted() []string {
+	return nonNil(r.presence.NotVoted)
+}
+
+type ballotResolver struct {
+	ballot Ballot
+}
+
+func (r *ballotResolver) Seq() int32 {
+	return int32(r.ballot.Seq)
+}
+
+func (r *ballotResolver) PrevHash() string {
+	return r.ballot.PrevHash
+}
+
+func (r *ballotResolver) Voter() string {
+	return r.ballot.Voter
+}
+
+func (r *ballotResolver) Vote() bool {
+	return r.ballot.Vote
+}
+
+func (r *ballotResolver) Timestamp() string {
+	return formatUnix(r.ballot.Timestamp)
+}
+
+func (r *ballotResolver) Hash() string {
+	return r.ballot.Hash
+}
+
+func (r *ballotResolver) Allocation() []*optionVotesResolver {
+	return optionVotesResolvers(r.ballot.Allocation)
+}
+
+type voteReceiptResolver struct {
+	receipt VoteReceipt
+}
+
+func (r *voteReceiptResolver) SessionID() graphql.ID {
+	return graphql.ID(r.receipt.SessionID)
+}
+
+func (r *voteReceiptResolver) Seq() int32 {
+	return int32(r.receipt.Seq)
+}
+
+func (r *voteReceiptResolver) Voter() string {
+	return r.receipt.Voter
+}
+
+func (r *voteReceiptResolver) Hash() string {
+	return r.receipt.Hash
+}
+
+type delegationResolver struct {
+	from string
+	to   string
+}
+
+func (r *delegationResolver) From() string {
+	return r.from
+}
+
+func (r *delegationResolver) To() string {
+	return r.to
+}
+
+func delegationResolvers(delegations map[string]string) []*delegationResolver {
+	resolvers := make([]*delegationResolver, 0, len(delegations))
+	for _, from := range sortedKeys(delegations) {
+		resolvers = append(resolvers, &delegationResolver{from: from, to: delegations[from]})
+	}
+	return resolvers
+}
+
+// sessionEventResolver resolves an event envelope pushed to a subscription
+type sessionEventResolver struct {
+	event   *rawEvent
+	session *sessionResolver
+}
+
+func newSessionEventResolver(data []byte) (*sessionEventResolver, error) {
+	event, err := decodeEvent(data)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := &sessionEventResolver{event: event}
+	if carriesSession(event.Type) {
+		var view SessionView
+		if err := json.Unmarshal(event.Payload, &view); err != nil {
+			return nil, err
+		}
+		resolver.session = &sessionResolver{view: &view}
+	}
+	return resolver, nil
+}
+
+func (r *sessionEventResolver) Version() int32 {
+	return int32(r.event.Version)
+}
+
+func (r *sessionEventResolver) Type() string {
+	return r.event.Type
+}
+
+func (r *sessionEventResolver) SessionID() graphql.ID {
+	return graphql.ID(r.event.SessionID)
+}
+
+func (r *sessionEventResolver) Seq() int32 {
+	return int32(r.event.Seq)
+}
+
+func (r *sessionEventResolver) Timestamp() string {
+	return r.event.Timestamp.Format(time.RFC3339Nano)
+}
+
+func (r *sessionEventResolver) Session() *sessionResolver {
+	return r.session
+}
+
+func (r *sessionEventResolver) Payload() *string {
+	if r.session != nil {
+		return nil
+	}
+	payload := string(r.event.Payload)
+	return &payload
+}
+
+// formatUnix renders Unix seconds as an RFC 3339 time
+func formatUnix(seconds int64) string {
+	return time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+}
+
+// nonNil turns a nil list into an empty one for non-null GraphQL lists
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+// sortedKeys returns the keys of a map in order, so map backed lists resolve deterministically
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
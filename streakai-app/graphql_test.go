@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type graphQLTestResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string            `json:"message"`
+		Extensions map[string]string `json:"extensions"`
+	} `json:"errors"`
+}
+
+// graphQLQuery runs a query as the user over POST /v1/graphql
+func graphQLQuery(t *testing.T, user string, query string) *graphQLTestResponse {
+	t.Helper()
+	body, _ := json.Marshal(graphQLRequest{Query: query})
+	resp, data := apiRequest(t, http.MethodPost, "/v1/graphql", user, nil, string(body))
+	expectStatus(t, resp, data, http.StatusOK)
+	var response graphQLTestResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		t.Fatal(err)
+	}
+	return &response
+}
+
+func sessionIDs(t *testing.T, data json.RawMessage) []string {
+	t.Helper()
+	var sessions []struct{ ID string }
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		ids = append(ids, session.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestGraphQLUserSessions(t *testing.T) {
+	owned := []string{createTestSession(t, "gwen", `{"name":"first"}`), createTestSession(t, "gwen", `{"name":"second"}`)}
+	sort.Strings(owned)
+	voted := createTestSession(t, "hal", `{"name":"voted"}`)
+	castTestVote(t, "gwen", voted)
+	resp, data := apiRequest(t, http.MethodPatch, "/v1/sessions", "gwen", nil, `{"id":"`+voted+`","vote":false,"change":true}`)
+	expectStatus(t, resp, data, http.StatusOK)
+
+	response := graphQLQuery(t, "gwen", `{ me { ownedSessions { id } votedSessions { id } } }`)
+	if len(response.Errors) > 0 {
+		t.Fatalf("errors: %+v", response.Errors)
+	}
+	var me struct {
+		OwnedSessions json.RawMessage
+		VotedSessions json.RawMessage
+	}
+	json.Unmarshal(response.Data["me"], &me)
+	if ids := sessionIDs(t, me.OwnedSessions); strings.Join(ids, ",") != strings.Join(owned, ",") {
+		t.Errorf("owned sessions %v, want %v", ids, owned)
+	}
+	if ids := sessionIDs(t, me.VotedSessions); len(ids) != 1 || ids[0] != voted {
+		t.Errorf("voted sessions %v, want [%s]", ids, voted)
+	}
+
+	// deleting a session drops it from the lists of its owner and voters
+	resp, data = apiRequest(t, http.MethodPost, "/v1/bulk/sessions/delete", "hal", nil, `{"ids":["`+voted+`"]}`)
+	expectStatus(t, resp, data, http.StatusOK)
+	response = graphQLQuery(t, "gwen", `{ user(username: "hal") { ownedSessions { id } } me { votedSessions { id } } }`)
+	if string(response.Data["user"]) != `{"ownedSessions":[]}` || string(response.Data["me"]) != `{"votedSessions":[]}` {
+		t.Errorf("lists after deleting: %s %s", response.Data["user"], response.Data["me"])
+	}
+}
+
+func TestGraphQLLimitsSessionLoads(t *testing.T) {
+	response := graphQLQuery(t, "alice", `{ session(id: "missing") { id } }`)
+	if len(response.Errors) > 0 || string(response.Data["session"]) != "null" {
+		t.Errorf("unknown session: %s %+v", response.Data["session"], response.Errors)
+	}
+
+	var query strings.Builder
+	query.WriteString("{")
+	for i := 0; i <= graphQLMaxSessions; i++ {
+		query.WriteString(" s" + strconv.Itoa(i) + `: session(id: "missing") { id }`)
+	}
+	query.WriteString(" }")
+	response = graphQLQuery(t, "alice", query.String())
+	if len(response.Errors) != 1 || response.Errors[0].Extensions["code"] != "unprocessable" {
+		t.Fatalf("%d errors: %+v", len(response.Errors), response.Errors)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// graphQLWSProtocol is the websocket subprotocol of GraphQL subscriptions
+const graphQLWSProtocol = "graphql-transport-ws"
+
+// graphql-transport-ws message types
+const (
+	gqlConnectionInit = "connection_init"
+	gqlConnectionAck  = "connection_ack"
+	gqlPing           = "ping"
+	gqlPong           = "pong"
+	gqlSubscribe      = "subscribe"
+	gqlNext           = "next"
+	gqlError          = "error"
+	gqlComplete       = "complete"
+)
+
+// graphql-transport-ws close codes
+const (
+	gqlCloseBadRequest        = 4400
+	gqlCloseUnauthorized      = 4401
+	gqlCloseForbidden         = 4403
+	gqlCloseNotAcceptable     = 4406
+	gqlCloseInitTimeout       = 4408
+	gqlCloseSubscriberExists  = 4409
+	gqlCloseTooManyInitialise = 4429
+)
+
+var graphQLUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
+	Subprotocols:    []string{graphQLWSProtocol},
+}
+
+// gqlMessage is a graphql-transport-ws message
+type gqlMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// gqlConnection is a graphql-transport-ws connection running any number of operations
+type gqlConnection struct {
+	conn       *websocket.Conn
+	writeMu    sync.Mutex
+	ctx        context.Context
+	mu         sync.Mutex
+	operations map[string]*gqlOperation
+}
+
+// gqlOperation is a running operation of a connection
+type gqlOperation struct {
+	cancel context.CancelFunc
+}
+
+// serveGraphQLWS runs the graphql-transport-ws protocol. The token is taken from the
+// Authorization header or the authorization field of the connection_init payload.
+func serveGraphQLWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := graphQLUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error upgrading GraphQL connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	c := &gqlConnection{conn: conn, operations: make(map[string]*gqlOperation)}
+	if conn.Subprotocol() != graphQLWSProtocol {
+		c.close(gqlCloseNotAcceptable, "Subprotocol not acceptable")
+		return
+	}
+
+	token, username, ok := c.init(r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), usernameKey{}, username))
+	defer cancel()
+	c.ctx = ctx
+
+	go monitorToken(token, username, ctx.Done(), func(reason string) {
+		c.close(gqlCloseForbidden, reason)
+	})
+	go c.keepAlive()
+	c.readLoop()
+}
+
+// init waits for connection_init, authenticates it and acknowledges the connection
+func (c *gqlConnection) init(r *http.Request) (string, string, bool) {
+	c.conn.SetReadDeadline(time.Now().Add(wsAuthTimeout))
+	var msg gqlMessage
+	if err := c.conn.ReadJSON(&msg); err != nil {
+		c.close(gqlCloseInitTimeout, "Connection initialisation timeout")
+		return "", "", false
+	}
+	if msg.Type != gqlConnectionInit {
+		c.close(gqlCloseUnauthorized, "Unauthorized")
+		return "", "", false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" && len(msg.Payload) > 0 {
+		var payload struct {
+			Authorization string `json:"authorization"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+		token = strings.TrimPrefix(payload.Authorization, "Bearer ")
+	}
+	username, err := checkToken(token)
+	if err != nil {
+		log.Printf("GraphQL websocket authentication failed: %v", err)
+		c.close(gqlCloseForbidden, "Forbidden")
+		return "", "", false
+	}
+
+	if err := c.write(gqlMessage{Type: gqlConnectionAck}); err != nil {
+		return "", "", false
+	}
+	return token, username, true
+}
+
+// readLoop dispatches client messages until the connection closes, then cancels the running operations
+func (c *gqlConnection) readLoop() {
+	defer c.cancelAll()
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		var msg gqlMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("GraphQL websocket read error: %v", err)
+			}
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		switch msg.Type {
+		case gqlPing:
+			c.write(gqlMessage{Type: gqlPong})
+		case gqlPong:
+		case gqlConnectionInit:
+			c.close(gqlCloseTooManyInitialise, "Too many initialisation requests")
+			return
+		case gqlSubscribe:
+			if !c.start(msg) {
+				return
+			}
+		case gqlComplete:
+			c.stop(msg.ID)
+		default:
+			c.close(gqlCloseBadRequest, "Invalid message type "+msg.Type)
+			return
+		}
+	}
+}
+
+// start runs an operation, streaming each result as a next message until it completes
+func (c *gqlConnection) start(msg gqlMessage) bool {
+	var req graphQLRequest
+	if msg.ID == "" || json.Unmarshal(msg.Payload, &req) != nil {
+		c.close(gqlCloseBadRequest, "Invalid subscribe message")
+		return false
+	}
+
+	c.mu.Lock()
+	if _, exists := c.operations[msg.ID]; exists {
+		c.mu.Unlock()
+		c.close(gqlCloseSubscriberExists, "Subscriber for "+msg.ID+" already exists")
+		return false
+	}
+	ctx, cancel := context.WithCancel(withSessionLoadLimit(c.ctx))
+	op := &gqlOperation{cancel: cancel}
+	c.operations[msg.ID] = op
+	c.mu.Unlock()
+
+	go func() {
+		defer c.finish(msg.ID, op)
+		results, err := graphQLSchema.Subscribe(ctx, req.Query, req.OperationName, req.Variables)
+		if err != nil {
+			c.sendErrors(msg.ID, []map[string]string{{"message": err.Error()}})
+			return
+		}
+
+		for result := range results {
+			response, ok := result.(*graphql.Response)
+			if !ok {
+				continue
+			}
+			if response.Data == nil && len(response.Errors) > 0 {
+				// the operation failed before it produced any result, the protocol reports this without completing
+				c.sendErrors(msg.ID, response.Errors)
+				return
+			}
+			payload, err := json.Marshal(response)
+			if err != nil {
+				log.Printf("Error encoding GraphQL result: %v", err)
+				continue
+			}
+			if err := c.write(gqlMessage{ID: msg.ID, Type: gqlNext, Payload: payload}); err != nil {
+				return
+			}
+		}
+		if ctx.Err() == nil {
+			c.write(gqlMessage{ID: msg.ID, Type: gqlComplete})
+		}
+	}()
+	return true
+}
+
+// sendErrors fails an operation with its list of GraphQL errors
+func (c *gqlConnection) sendErrors(id string, errs interface{}) {
+	payload, _ := json.Marshal(errs)
+	c.write(gqlMessage{ID: id, Type: gqlError, Payload: payload})
+}
+
+// stop cancels an operation on the client's request, after which its ID may be reused
+func (c *gqlConnection) stop(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if op, ok := c.operations[id]; ok {
+		op.cancel()
+		delete(c.operations, id)
+	}
+}
+
+// finish releases an operation that ended, unless the client already reused its ID
+func (c *gqlConnection) finish(id string, op *gqlOperation) {
+	op.cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.operations[id] == op {
+		delete(c.operations, id)
+	}
+}
+
+func (c *gqlConnection) cancelAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, op := range c.operations {
+		op.cancel()
+		delete(c.operations, id)
+	}
+}
+
+// keepAlive pings the client so dead connections are detected by the read deadline
+func (c *gqlConnection) keepAlive() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *gqlConnection) write(msg gqlMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteJSON(msg)
+}
+
+// close ends the connection with a graphql-transport-ws close code
+func (c *gqlConnection) close(code int, reason string) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	c.conn.Close()
+}
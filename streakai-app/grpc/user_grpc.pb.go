@@ -1,7 +1,7 @@
 // Code generated by protoc-gen-go-grpc. DO NOT EDIT.
 // versions:
-// - protoc-gen-go-grpc v1.2.0
-// - protoc             v4.22.3
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
 // source: user.proto
 
 package grpc
@@ -15,12 +15,22 @@ import (
 
 // This is a compile-time assertion to ensure that this generated file
 // is compatible with the grpc package it is being compiled against.
-// Requires gRPC-Go v1.32.0 or later.
-const _ = grpc.SupportPackageIsVersion7
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	StreakAiService_Login_FullMethodName           = "/grpc.StreakAiService/Login"
+	StreakAiService_Register_FullMethodName        = "/grpc.StreakAiService/Register"
+	StreakAiService_LogOut_FullMethodName          = "/grpc.StreakAiService/LogOut"
+	StreakAiService_CheckAuthorized_FullMethodName = "/grpc.StreakAiService/CheckAuthorized"
+)
 
 // StreakAiServiceClient is the client API for StreakAiService service.
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// StreakAiService is served by streakai-auth, the app transcodes its REST routes from the http options below.
+// LogOut reads the token from the authorization metadata when authCode is empty.
 type StreakAiServiceClient interface {
 	Login(ctx context.Context, in *LoginRequest, opts ...grpc.CallOption) (*LoginResponse, error)
 	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
@@ -37,8 +47,9 @@ func NewStreakAiServiceClient(cc grpc.ClientConnInterface) StreakAiServiceClient
 }
 
 func (c *streakAiServiceClient) Login(ctx context.Context, in *LoginRequest, opts ...grpc.CallOption) (*LoginResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	out := new(LoginResponse)
-	err := c.cc.Invoke(ctx, "/grpc.StreakAiService/Login", in, out, opts...)
+	err := c.cc.Invoke(ctx, StreakAiService_Login_FullMethodName, in, out, cOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -46,8 +57,9 @@ func (c *streakAiServiceClient) Login(ctx context.Context, in *LoginRequest, opt
 }
 
 func (c *streakAiServiceClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	out := new(RegisterResponse)
-	err := c.cc.Invoke(ctx, "/grpc.StreakAiService/Register", in, out, opts...)
+	err := c.cc.Invoke(ctx, StreakAiService_Register_FullMethodName, in, out, cOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -55,8 +67,9 @@ func (c *streakAiServiceClient) Register(ctx context.Context, in *RegisterReques
 }
 
 func (c *streakAiServiceClient) LogOut(ctx context.Context, in *LogOutRequest, opts ...grpc.CallOption) (*LogOutResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	out := new(LogOutResponse)
-	err := c.cc.Invoke(ctx, "/grpc.StreakAiService/LogOut", in, out, opts...)
+	err := c.cc.Invoke(ctx, StreakAiService_LogOut_FullMethodName, in, out, cOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -64,8 +77,9 @@ func (c *streakAiServiceClient) LogOut(ctx context.Context, in *LogOutRequest, o
 }
 
 func (c *streakAiServiceClient) CheckAuthorized(ctx context.Context, in *CheckAuthorizedReq, opts ...grpc.CallOption) (*CheckAuthorizedRes, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	out := new(CheckAuthorizedRes)
-	err := c.cc.Invoke(ctx, "/grpc.StreakAiService/CheckAuthorized", in, out, opts...)
+	err := c.cc.Invoke(ctx, StreakAiService_CheckAuthorized_FullMethodName, in, out, cOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -75,6 +89,9 @@ func (c *streakAiServiceClient) CheckAuthorized(ctx context.Context, in *CheckAu
 // StreakAiServiceServer is the server API for StreakAiService service.
 // All implementations must embed UnimplementedStreakAiServiceServer
 // for forward compatibility
+//
+// StreakAiService is served by streakai-auth, the app transcodes its REST routes from the http options below.
+// LogOut reads the token from the authorization metadata when authCode is empty.
 type StreakAiServiceServer interface {
 	Login(context.Context, *LoginRequest) (*LoginResponse, error)
 	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
@@ -122,7 +139,7 @@ func _StreakAiService_Login_Handler(srv interface{}, ctx context.Context, dec fu
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/grpc.StreakAiService/Login",
+		FullMethod: StreakAiService_Login_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
 		return srv.(StreakAiServiceServer).Login(ctx, req.(*LoginRequest))
@@ -140,7 +157,7 @@ func _StreakAiService_Register_Handler(srv interface{}, ctx context.Context, dec
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/grpc.StreakAiService/Register",
+		FullMethod: StreakAiService_Register_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
 		return srv.(StreakAiServiceServer).Register(ctx, req.(*RegisterRequest))
@@ -158,7 +175,7 @@ func _StreakAiService_LogOut_Handler(srv interface{}, ctx context.Context, dec f
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/grpc.StreakAiService/LogOut",
+		FullMethod: StreakAiService_LogOut_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
 		return srv.(StreakAiServiceServer).LogOut(ctx, req.(*LogOutRequest))
@@ -176,7 +193,7 @@ func _StreakAiService_CheckAuthorized_Handler(srv interface{}, ctx context.Conte
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/grpc.StreakAiService/CheckAuthorized",
+		FullMethod: StreakAiService_CheckAuthorized_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
 		return srv.(StreakAiServiceServer).CheckAuthorized(ctx, req.(*CheckAuthorizedReq))
@@ -3,13 +3,16 @@ package main
 import (
 	"log"
 	"net/http"
+
+	"github.com/gorilla/mux"
 )
 
 func handleSessions(w http.ResponseWriter, r *http.Request) {
 	// CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS,DELETE")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, OPTIONS, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match, If-None-Match, "+idempotencyKeyHeader)
+	w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 	// Handle OPTIONS request
 	if r.Method == http.MethodOptions {
@@ -19,15 +22,36 @@ func handleSessions(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Session handler  hit: %s %s", r.Method, r.URL.Path)
 
-	switch r.Method {
-	case http.MethodPost: //adds a new voting session
-		createSessionHandler(w, r)
-	case http.MethodPatch: //cast a vote to a session
-		castVote(w, r)
-	case http.MethodGet: //fetches voting session
-		getSessionHandler(w, r)
+	id := mux.Vars(r)["id"]
+	switch {
+	case r.Method == http.MethodGet && id != "" && r.Header.Get("If-None-Match") != "":
+		// answer polling clients that are up to date without computing the session view, authenticating
+		// them first like the VotingService would
+		if _, isAuthorised := isAuthorised(w, r); !isAuthorised {
+			return
+		}
+		if session, err := getSession(id); err == nil {
+			etag := sessionETag(session.Version)
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				w.Header().Set("ETag", etag)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	case r.Method == http.MethodPut && r.Header.Get("If-Match") == "":
+		sendError(w, "If-Match with the ETag of the session is required", http.StatusPreconditionRequired)
+		return
+	}
+
+	// creating (POST), voting (PATCH), fetching (GET) and editing (PUT) are transcoded to the VotingService
+	transcode(w, r)
+}
 
-	default:
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+// closeSessionHandler requires the ETag the owner is closing, like edits, before transcoding to the VotingService
+func closeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("If-Match") == "" {
+		sendError(w, "If-Match with the ETag of the session is required", http.StatusPreconditionRequired)
+		return
 	}
+	transcode(w, r)
 }
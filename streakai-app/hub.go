@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// writeWait is the time allowed to write a message to the peer
+	writeWait = 10 * time.Second
+	// pongWait is the time allowed to read the next pong from the peer
+	pongWait = 60 * time.Second
+	// pingPeriod must be shorter than pongWait so a healthy peer answers in time
+	pingPeriod = (pongWait * 9) / 10
+	// maxMessageSize is the largest message accepted from a client
+	maxMessageSize = 4096
+	// sendBufferSize is how many messages may queue for a client before it counts as a slow consumer
+	sendBufferSize = 64
+)
+
+// Hub tracks the websocket clients and fans session updates out to their subscribers only.
+// Messages are queued per client and written by the client's own goroutine,
+// so a stuck connection never blocks the request that produced the update.
+type Hub struct {
+	mu      sync.Mutex
+	clients map[*Client]bool
+}
+
+// Client is a websocket connection, or a Server-Sent Events stream when conn is nil,
+// together with the sessions and workspaces it subscribed to
+type Client struct {
+	// id identifies the connection in the presence of the sessions it views
+	id         string
+	conn       *websocket.Conn
+	send       chan []byte
+	username   string
+	token      string
+	done       chan struct{}
+	sessions   map[string]bool
+	workspaces map[string]bool
+}
+
+func newHub() *Hub {
+	return &Hub{clients: make(map[*Client]bool)}
+}
+
+func newClient(conn *websocket.Conn, username string, token string) *Client {
+	return &Client{
+		id:         uuid.New().String(),
+		conn:       conn,
+		send:       make(chan []byte, sendBufferSize),
+		username:   username,
+		token:      token,
+		done:       make(chan struct{}),
+		sessions:   make(map[string]bool),
+		workspaces: make(map[string]bool),
+	}
+}
+
+func (h *Hub) register(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[client] = true
+}
+
+func (h *Hub) unregister(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(client)
+}
+
+// removeLocked drops a client, its writer exits once the send queue is closed. h.mu must be held.
+func (h *Hub) removeLocked(client *Client) {
+	if h.clients[client] {
+		delete(h.clients, client)
+		close(client.done)
+		close(client.send)
+		if client.conn != nil {
+			client.conn.Close()
+		}
+
+		sessionIDs := make([]string, 0, len(client.sessions))
+		for sessionID := range client.sessions {
+			sessionIDs = append(sessionIDs, sessionID)
+		}
+		go leaveSessions(sessionIDs, client.id, client.username)
+	}
+}
+
+// enqueueLocked queues data for a client, disconnecting it if its queue is full. h.mu must be held.
+func (h *Hub) enqueueLocked(client *Client, data []byte) {
+	if !h.clients[client] {
+		return
+	}
+	select {
+	case client.send <- data:
+	default:
+		log.Printf("Disconnecting slow websocket client %s", client.username)
+		h.removeLocked(client)
+	}
+}
+
+// sendTo queues data for a single client
+func (h *Hub) sendTo(client *Client, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.enqueueLocked(client, data)
+}
+
+// subscribe adds a session or workspace subscription for the client.
+// Subscribing to a session marks the user as present in it.
+func (h *Hub) subscribe(client *Client, msg ClientMessage) {
+	h.mu.Lock()
+	joined := false
+	if msg.SessionID != "" && !client.sessions[msg.SessionID] {
+		client.sessions[msg.SessionID] = true
+		joined = true
+	}
+	if msg.Workspace != "" {
+		client.workspaces[msg.Workspace] = true
+	}
+	h.mu.Unlock()
+
+	if joined {
+		joinSession(msg.SessionID, client)
+	}
+}
+
+// unsubscribe removes a session or workspace subscription from the client
+func (h *Hub) unsubscribe(client *Client, msg ClientMessage) {
+	h.mu.Lock()
+	left := client.sessions[msg.SessionID]
+	delete(client.sessions, msg.SessionID)
+	delete(client.workspaces, msg.Workspace)
+	h.mu.Unlock()
+
+	if left {
+		leaveSessions([]string{msg.SessionID}, client.id, client.username)
+	}
+}
+
+// presence returns the presence members of the connected clients by session, for their heartbeat
+func (h *Hub) presence() map[string][]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	connections := make(map[string][]string)
+	for client := range h.clients {
+		for sessionID := range client.sessions {
+			connections[sessionID] = append(connections[sessionID], presenceMember(client.id, client.username))
+		}
+	}
+	return connections
+}
+
+// publish queues the data for every subscriber of the session directly or through its workspace,
+// restricted to the given users when recipients is not empty
+func (h *Hub) publish(sessionID string, workspace string, recipients []string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		if !client.sessions[sessionID] && (workspace == "" || !client.workspaces[workspace]) {
+			continue
+		}
+		if len(recipients) > 0 && !containsUser(recipients, client.username) {
+			continue
+		}
+		h.enqueueLocked(client, data)
+	}
+}
+
+// containsUser reports whether the username is in the list
+func containsUser(users []string, username string) bool {
+	for _, u := range users {
+		if u == username {
+			return true
+		}
+	}
+	return false
+}
+
+// writePump writes queued messages and keepalive pings to the connection
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("Error writing message to client: %v", err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readPump handles subscription messages until the connection is closed
+// and evicts the client once the peer stops answering pings.
+func (c *Client) readPump(h *Hub) {
+	defer h.unregister(c)
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("WebSocket read error: %v", err)
+			}
+			return
+		}
+
+		var msg ClientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("Error decoding websocket message: %v", err)
+			continue
+		}
+
+		switch msg.Action {
+		case "subscribe":
+			h.subscribe(c, msg)
+			c.resume(h, msg)
+		case "unsubscribe":
+			h.unsubscribe(c, msg)
+		default:
+			c.handleCommand(h, msg)
+		}
+	}
+}
+
+// sendSnapshot sends the current state of the subscribed session, or of every session in the workspace
+func (c *Client) sendSnapshot(h *Hub, msg ClientMessage) {
+	var ids []string
+	if msg.SessionID != "" {
+		ids = append(ids, msg.SessionID)
+	}
+	if msg.Workspace != "" {
+		workspaceIDs, err := getWorkspaceSessionIDs(msg.Workspace)
+		if err != nil {
+			log.Printf("Error loading workspace sessions: %v", err)
+			return
+		}
+		ids = append(ids, workspaceIDs...)
+	}
+
+	for _, id := range ids {
+		session, err := getSession(id)
+		if err != nil {
+			log.Printf("Error loading session for snapshot: %v", err)
+			continue
+		}
+		event, err := newSessionEvent(eventSessionSnapshot, session)
+		if err != nil {
+			log.Printf("Error building snapshot: %v", err)
+			continue
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Error encoding session data: %v", err)
+			continue
+		}
+		h.sendTo(c, data)
+	}
+}
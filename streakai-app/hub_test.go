@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+)
+
+// queued returns the messages waiting in the client's send queue without blocking
+func queued(client *Client) [][]byte {
+	var messages [][]byte
+	for {
+		select {
+		case data, ok := <-client.send:
+			if !ok {
+				return messages
+			}
+			messages = append(messages, data)
+		default:
+			return messages
+		}
+	}
+}
+
+func TestHubFansOutToSubscribers(t *testing.T) {
+	first := createTestSession(t, "alice", `{"name":"viewed","workspace":"hub"}`)
+	second := createTestSession(t, "alice", `{"name":"elsewhere"}`)
+	h := newHub()
+	viewer, watcher, other, outsider := newClient(nil, "bob", ""), newClient(nil, "carol", ""), newClient(nil, "dave", ""), newClient(nil, "erin", "")
+	for _, client := range []*Client{viewer, watcher, other, outsider} {
+		h.register(client)
+		defer h.unregister(client)
+	}
+	h.subscribe(viewer, ClientMessage{SessionID: first})
+	h.subscribe(watcher, ClientMessage{Workspace: "hub"})
+	h.subscribe(other, ClientMessage{SessionID: second})
+
+	h.publish(first, "hub", nil, []byte(`update`))
+	for client, want := range map[*Client]int{viewer: 1, watcher: 1, other: 0, outsider: 0} {
+		if got := len(queued(client)); got != want {
+			t.Errorf("%s received %d messages, want %d", client.username, got, want)
+		}
+	}
+
+	h.publish(first, "hub", []string{"carol"}, []byte(`private`))
+	if len(queued(viewer)) != 0 || len(queued(watcher)) != 1 {
+		t.Errorf("a message for carol only reached the other subscribers")
+	}
+
+	h.unsubscribe(viewer, ClientMessage{SessionID: first})
+	h.unsubscribe(watcher, ClientMessage{Workspace: "hub"})
+	h.publish(first, "hub", nil, []byte(`update`))
+	if len(queued(viewer)) != 0 || len(queued(watcher)) != 0 {
+		t.Errorf("unsubscribed clients still receive the session")
+	}
+}
+
+func TestSubscribeSendsSnapshot(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"snapshot","workspace":"snapshots"}`)
+	castTestVote(t, "bob", id)
+	h := newHub()
+	client := newClient(nil, "carol", "")
+	h.register(client)
+	defer h.unregister(client)
+
+	client.sendSnapshot(h, ClientMessage{Workspace: "snapshots"})
+	messages := queued(client)
+	if len(messages) != 1 {
+		t.Fatalf("%d snapshots sent", len(messages))
+	}
+	event, err := decodeEvent(messages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, _ := currentEventSeq(id)
+	if event.Type != eventSessionSnapshot || event.SessionID != id || event.Seq != seq {
+		t.Errorf("snapshot %+v, want seq %d", event.Event, seq)
+	}
+}
+
+func TestHubDropsSlowConsumer(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"backpressure"}`)
+	h := newHub()
+	slow, reader := newClient(nil, "bob", ""), newClient(nil, "carol", "")
+	for _, client := range []*Client{slow, reader} {
+		h.register(client)
+		defer h.unregister(client)
+		h.subscribe(client, ClientMessage{SessionID: id})
+	}
+
+	received := 0
+	for i := 0; i <= sendBufferSize; i++ {
+		h.publish(id, "", nil, []byte(`update`))
+		received += len(queued(reader))
+	}
+	if received != sendBufferSize+1 {
+		t.Errorf("the reader received %d of %d messages", received, sendBufferSize+1)
+	}
+	select {
+	case <-slow.done:
+	default:
+		t.Fatalf("the slow consumer is still connected")
+	}
+	if messages := queued(slow); len(messages) != sendBufferSize {
+		t.Errorf("%d messages were left for the slow consumer", len(messages))
+	}
+	h.publish(id, "", nil, []byte(`update`))
+	if len(queued(reader)) != 1 {
+		t.Errorf("the reader stopped receiving after the slow consumer was dropped")
+	}
+}
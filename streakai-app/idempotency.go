@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// idempotencyKeyHeader lets clients retry a POST or PATCH without repeating its effect
+const idempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	// idempotencyTTL is how long the response to a key is replayed
+	idempotencyTTL = 24 * time.Hour
+	// idempotencyPendingTTL frees a key whose first request never completed, e.g. because the server stopped
+	idempotencyPendingTTL   = time.Minute
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotencyMiddleware stores the first response to an authenticated POST or PATCH carrying an Idempotency-Key
+// and replays it to retries with the same key and body. Keys are scoped to the caller's username, method and path.
+func idempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPatch) || r.Header.Get("Authorization") == "" {
+			// without credentials there is no one to scope the key to, so login, register and chat-ops run every time
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			sendError(w, "Idempotency-Key must be at most 255 characters", http.StatusBadRequest)
+			return
+		}
+		username, isAuthorised := isAuthorised(w, r)
+		if !isAuthorised {
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), usernameKey{}, username))
+
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := idempotencyScope(r, username, key)
+		record := &IdempotencyRecord{Fingerprint: hashHex(body)}
+		reserved, err := reserveIdempotencyKey(scope, record, idempotencyPendingTTL)
+		if err != nil {
+			log.Printf("Error reserving idempotency key: %v", err)
+			sendError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !reserved {
+			replayIdempotentResponse(w, scope, record.Fingerprint)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		if releasesIdempotencyKey(recorder.status) {
+			// transient failures are not remembered so the retry runs the request again
+			if err := releaseIdempotencyKey(scope); err != nil {
+				log.Printf("Error releasing idempotency key: %v", err)
+			}
+		} else {
+			record.Status = recorder.status
+			record.Header = w.Header().Clone()
+			record.Header.Del(requestIDHeader)
+			record.Body = recorder.body.Bytes()
+			if err := setIdempotencyRecord(scope, record, idempotencyTTL); err != nil {
+				log.Printf("Error storing idempotent response: %v", err)
+			}
+		}
+
+		w.WriteHeader(recorder.status)
+		w.Write(recorder.body.Bytes())
+	})
+}
+
+// replayIdempotentResponse answers a retry with the stored response, unless the body changed or the first request is still running
+func replayIdempotentResponse(w http.ResponseWriter, scope string, fingerprint string) {
+	record, err := getIdempotencyRecord(scope)
+	if err != nil {
+		// the key expired between the two calls
+		sendError(w, "Idempotency-Key expired, please retry", http.StatusConflict)
+		return
+	}
+	if record.Fingerprint != fingerprint {
+		sendError(w, "Idempotency-Key was already used with a different request body", http.StatusUnprocessableEntity)
+		return
+	}
+	if record.Status == 0 {
+		sendError(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+		return
+	}
+
+	for name, values := range record.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+}
+
+// releasesIdempotencyKey reports the statuses a retry may succeed after: an expired or refreshed token,
+// a timeout, a rate limit and server errors
+func releasesIdempotencyKey(status int) bool {
+	return status >= 500 || status == http.StatusUnauthorized || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// idempotencyScope identifies a key by the user who sent it and the route it was sent to,
+// the unversioned aliases sharing the keys of their /v1 route
+func idempotencyScope(r *http.Request, username string, key string) string {
+	path := strings.TrimPrefix(r.URL.Path, apiVersionPrefix)
+	return username + ":" + r.Method + ":" + path + ":" + key
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
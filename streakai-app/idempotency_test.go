@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIdempotencyKeysAreScopedToUsers(t *testing.T) {
+	key := map[string]string{idempotencyKeyHeader: "create-once"}
+	body := `{"name":"idempotent"}`
+
+	resp, first := apiRequest(t, http.MethodPost, "/v1/sessions", "alice", key, body)
+	expectStatus(t, resp, first, http.StatusOK)
+	resp, replayed := apiRequest(t, http.MethodPost, "/sessions", "alice", key, body)
+	expectStatus(t, resp, replayed, http.StatusOK)
+	if resp.Header.Get("Idempotent-Replayed") != "true" || string(replayed) != string(first) {
+		t.Errorf("retry was not replayed: %s", replayed)
+	}
+	resp, data := apiRequest(t, http.MethodPost, "/v1/sessions", "alice", key, `{"name":"changed"}`)
+	expectStatus(t, resp, data, http.StatusUnprocessableEntity)
+
+	// another user does not share the key, and an invalid token is rejected before the key is looked up
+	resp, data = apiRequest(t, http.MethodPost, "/v1/sessions", "bob", key, body)
+	expectStatus(t, resp, data, http.StatusOK)
+	if resp.Header.Get("Idempotent-Replayed") != "" || string(data) == string(first) {
+		t.Errorf("bob received alice's response: %s", data)
+	}
+	resp, data = apiRequest(t, http.MethodPost, "/v1/sessions", "", map[string]string{
+		idempotencyKeyHeader: "create-once", "Authorization": "Bearer forged",
+	}, body)
+	expectStatus(t, resp, data, http.StatusUnauthorized)
+}
+
+func TestIdempotencyKeysAreReleasedOnRetryableFailures(t *testing.T) {
+	key := map[string]string{idempotencyKeyHeader: "unauthenticated-first"}
+	resp, data := apiRequest(t, http.MethodPost, "/v1/sessions", "", map[string]string{
+		idempotencyKeyHeader: "unauthenticated-first", "Authorization": "Bearer expired",
+	}, `{"name":"retried"}`)
+	expectStatus(t, resp, data, http.StatusUnauthorized)
+	resp, data = apiRequest(t, http.MethodPost, "/v1/sessions", "alice", key, `{"name":"retried"}`)
+	expectStatus(t, resp, data, http.StatusOK)
+
+	for _, status := range []int{http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		if !releasesIdempotencyKey(status) {
+			t.Errorf("%d keeps the key", status)
+		}
+	}
+	for _, status := range []int{http.StatusOK, http.StatusBadRequest, http.StatusForbidden, http.StatusConflict} {
+		if releasesIdempotencyKey(status) {
+			t.Errorf("%d releases the key", status)
+		}
+	}
+}
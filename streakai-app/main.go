@@ -1,29 +1,52 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
-
-	"github.com/gorilla/mux"
+	"os"
 )
 
 func main() {
 
 	sessions = make(AllSessions, 0)
+	allowedOrigins = parseAllowedOrigins(os.Getenv("ALLOWED_ORIGINS"))
+	chatOpsSecret = os.Getenv("CHATOPS_SIGNING_SECRET")
 
 	err := initGRPCConnection()
 	if err != nil {
 		log.Fatalf("Error initializing gRPC connection: %v", err)
 	}
 	initRedis()
-	router := mux.NewRouter()
-	router.HandleFunc("/login", handleLogin).Methods("POST")
-	router.HandleFunc("/register", handleRegister).Methods("POST")
-	router.HandleFunc("/logout", handleLogout).Methods("POST")
-	router.HandleFunc("/ws", handleWebSocket)
-	router.HandleFunc("/sessions", handleSessions)
-	router.HandleFunc("/sessions/{id}", handleSessions)
+	if err := indexUserSessions(); err != nil {
+		log.Fatalf("Error indexing user sessions: %v", err)
+	}
+	if err := initBallotTagKey(os.Getenv("BALLOT_TAG_KEY")); err != nil {
+		log.Fatalf("Error loading ballot tag key: %v", err)
+	}
+	subscribeEvents()
+	go sweepWebhookDeliveries()
+	go keepPresence()
+	if err := loadOpenAPI(); err != nil {
+		log.Fatalf("Error loading OpenAPI document: %v", err)
+	}
+	go func() {
+		log.Fatal(serveVotingService())
+	}()
+	fmt.Println("VotingService is running at localhost" + votingServiceAddr)
+	if err := initGateway(context.Background()); err != nil {
+		log.Fatalf("Error initializing REST gateway: %v", err)
+	}
+
+	if err := initGraphQL(); err != nil {
+		log.Fatalf("Error parsing GraphQL schema: %v", err)
+	}
+
+	router, err := newRouter()
+	if err != nil {
+		log.Fatalf("API routes drifted from the OpenAPI document: %v", err)
+	}
 
 	fmt.Println("Server is running at http://localhost:8080")
 	log.Fatal(http.ListenAndServe(":8080", router))
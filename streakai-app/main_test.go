@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "streakai/grpc"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// testServerURL is the app served by TestMain against an in-memory Redis and a fake auth service
+var testServerURL string
+
+// fakeAuthServer accepts the tokens "token-<username>" until they are revoked
+type fakeAuthServer struct {
+	pb.UnimplementedStreakAiServiceServer
+}
+
+// revokedTokens holds the tokens the fake auth service no longer accepts
+var revokedTokens sync.Map
+
+// revokeTestToken stops accepting the user's token for the rest of the test, as logging out would
+func revokeTestToken(t *testing.T, user string) {
+	revokedTokens.Store("token-"+user, true)
+	t.Cleanup(func() { revokedTokens.Delete("token-" + user) })
+}
+
+func (fakeAuthServer) CheckAuthorized(ctx context.Context, in *pb.CheckAuthorizedReq) (*pb.CheckAuthorizedRes, error) {
+	if _, revoked := revokedTokens.Load(in.AuthCode); revoked {
+		return &pb.CheckAuthorizedRes{}, status.Error(codes.Unauthenticated, "revoked token")
+	}
+	if username, ok := strings.CutPrefix(in.AuthCode, "token-"); ok && username != "" {
+		return &pb.CheckAuthorizedRes{Username: username, Authorized: true}, nil
+	}
+	return &pb.CheckAuthorizedRes{}, status.Error(codes.Unauthenticated, "invalid token")
+}
+
+func TestMain(m *testing.M) {
+	server, err := startTestServer()
+	if err != nil {
+		log.Fatalf("Error starting test server: %v", err)
+	}
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+// startTestServer wires the app as main does, with miniredis and the fake auth service
+func startTestServer() (*httptest.Server, error) {
+	store, err := miniredis.Run()
+	if err != nil {
+		return nil, err
+	}
+	redisClient = redis.NewClient(&redis.Options{Addr: store.Addr()})
+	sessions = make(AllSessions, 0)
+	// connections notice a revoked token quickly, set before any connection starts watching its token
+	tokenRecheckInterval = 20 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	auth := grpc.NewServer()
+	pb.RegisterStreakAiServiceServer(auth, fakeAuthServer{})
+	go auth.Serve(listener)
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	grpcClient = pb.NewStreakAiServiceClient(conn)
+
+	if err := initBallotTagKey(""); err != nil {
+		return nil, err
+	}
+	subscribeEvents()
+	go sweepWebhookDeliveries()
+	go keepPresence()
+	if err := loadOpenAPI(); err != nil {
+		return nil, err
+	}
+	go func() {
+		log.Fatal(serveVotingService())
+	}()
+	if err := initGateway(context.Background()); err != nil {
+		return nil, err
+	}
+	if err := initGraphQL(); err != nil {
+		return nil, err
+	}
+	router, err := newRouter()
+	if err != nil {
+		return nil, err
+	}
+	server := httptest.NewServer(router)
+	testServerURL = server.URL
+	return server, nil
+}
+
+// apiRequest sends a request to the test server as the user, without authentication when user is empty
+func apiRequest(t *testing.T, method string, path string, user string, headers map[string]string, body string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, testServerURL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if user != "" {
+		req.Header.Set("Authorization", "Bearer token-"+user)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+// expectStatus fails the test unless the response has the status
+func expectStatus(t *testing.T, resp *http.Response, data []byte, want int) {
+	t.Helper()
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: got %d, want %d: %s", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, want, data)
+	}
+}
+
+// createTestSession creates a session owned by the user over REST and returns its ID
+func createTestSession(t *testing.T, owner string, body string) string {
+	t.Helper()
+	resp, data := apiRequest(t, http.MethodPost, "/v1/sessions", owner, nil, body)
+	expectStatus(t, resp, data, http.StatusOK)
+	var created struct {
+		SessionID string `json:"sessionID"`
+	}
+	if err := json.Unmarshal(data, &created); err != nil || created.SessionID == "" {
+		t.Fatalf("no session ID in %s", data)
+	}
+	return created.SessionID
+}
+
+// subscribeTestClient registers a hub client of the user, as a connection would, subscribed as the message asks
+func subscribeTestClient(t *testing.T, user string, msg ClientMessage) *Client {
+	t.Helper()
+	client := newClient(nil, user, "token-"+user)
+	hub.register(client)
+	t.Cleanup(func() { hub.unregister(client) })
+	hub.subscribe(client, msg)
+	return client
+}
+
+// nextTestEvent returns the next event of the type queued for the client, skipping the others
+func nextTestEvent(t *testing.T, client *Client, eventType string) *rawEvent {
+	t.Helper()
+	for timeout := time.After(5 * time.Second); ; {
+		select {
+		case data, ok := <-client.send:
+			if !ok {
+				t.Fatalf("the client was disconnected")
+			}
+			event, err := decodeEvent(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a %s event", eventType)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gorilla/mux"
+)
+
+//go:embed openapi/openapi.yaml
+var openAPISpec []byte
+
+var (
+	openAPIDoc    *openapi3.T
+	openAPIRouter routers.Router
+)
+
+// loadOpenAPI parses and validates the embedded OpenAPI document and builds the router used to validate requests
+func loadOpenAPI() error {
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	if err != nil {
+		return fmt.Errorf("failed to load OpenAPI document: %v", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return fmt.Errorf("invalid OpenAPI document: %v", err)
+	}
+
+	// the event schema is served as JSON schema, which is still JSON to the response validator
+	openapi3filter.RegisterBodyDecoder("application/schema+json", openapi3filter.JSONBodyDecoder)
+
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return fmt.Errorf("failed to route OpenAPI document: %v", err)
+	}
+	openAPIDoc = doc
+	openAPIRouter = router
+	return nil
+}
+
+// handleOpenAPI serves the OpenAPI document describing the REST API
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	SendResponse(w, http.StatusOK, openAPIDoc)
+}
+
+// openAPIValidationMiddleware rejects requests that do not match the OpenAPI document
+// and logs responses that drift from it. Streaming operations only have their request validated.
+func openAPIValidationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := openAPIRouter.FindRoute(r)
+		if err != nil {
+			// not described by the document, e.g. CORS preflight requests
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+				MultiError:         true,
+			},
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			sendErrorDetails(w, "Request does not match the API specification", http.StatusBadRequest, validationDetails(err))
+			return
+		}
+
+		if _, streaming := route.Operation.Extensions["x-streaming"]; streaming {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		if err := openapi3filter.ValidateResponse(r.Context(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 recorder.status,
+			Header:                 w.Header(),
+			Body:                   io.NopCloser(bytes.NewReader(recorder.body.Bytes())),
+			Options:                &openapi3filter.Options{IncludeResponseStatus: true, MultiError: true},
+		}); err != nil {
+			reportResponseDrift(r, err)
+		}
+
+		w.WriteHeader(recorder.status)
+		w.Write(recorder.body.Bytes())
+	})
+}
+
+// reportResponseDrift is called with responses that do not match the OpenAPI document, tests make it fail
+var reportResponseDrift = func(r *http.Request, err error) {
+	log.Printf("Response to %s %s drifted from the API specification: %v", r.Method, r.URL.Path, err)
+}
+
+// validationDetails lists the individual problems of a validation error, pointing at the offending field
+func validationDetails(err error) []string {
+	var multi openapi3.MultiError
+	if errors.As(err, &multi) {
+		var details []string
+		for _, e := range multi {
+			details = append(details, validationDetails(e)...)
+		}
+		return details
+	}
+
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		return []string{"/" + strings.Join(schemaErr.JSONPointer(), "/") + ": " + schemaErr.Reason}
+	}
+
+	var requestErr *openapi3filter.RequestError
+	if errors.As(err, &requestErr) && requestErr.Err != nil {
+		var multi openapi3.MultiError
+		if errors.As(requestErr.Err, &multi) {
+			return validationDetails(multi)
+		}
+	}
+	return []string{err.Error()}
+}
+
+// responseRecorder buffers a response so it can be validated before it is sent
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	return r.body.Write(data)
+}
+
+// checkRouteContract fails when the routes registered under the prefix and the OpenAPI document
+// disagree on the paths or methods they serve, so handlers cannot drift from the specification unnoticed
+func checkRouteContract(router *mux.Router, prefix string) error {
+	served := make(map[string]map[string]bool)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(template, prefix+"/") {
+			return nil
+		}
+		path := strings.TrimPrefix(template, prefix)
+		methods, _ := route.GetMethods()
+		if served[path] == nil {
+			served[path] = make(map[string]bool)
+		}
+		for _, method := range methods {
+			served[path][method] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for path, methods := range served {
+		item := openAPIDoc.Paths.Find(path)
+		if item == nil {
+			problems = append(problems, "route "+path+" is not documented")
+			continue
+		}
+		for method := range methods {
+			if item.GetOperation(method) == nil {
+				problems = append(problems, method+" "+path+" is not documented")
+			}
+		}
+	}
+	for path, item := range openAPIDoc.Paths.Map() {
+		methods, ok := served[path]
+		if !ok {
+			problems = append(problems, "documented path "+path+" has no route")
+			continue
+		}
+		// routes that dispatch on the method themselves accept every documented operation
+		if len(methods) == 0 {
+			continue
+		}
+		for method := range item.Operations() {
+			if !methods[method] {
+				problems = append(problems, "documented "+method+" "+path+" has no route")
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRouteContract(t *testing.T) {
+	if _, err := newRouter(); err != nil {
+		t.Fatalf("routes drifted from openapi.yaml: %v", err)
+	}
+
+	router := mux.NewRouter()
+	v1 := router.PathPrefix(apiVersionPrefix).Subrouter()
+	registerRoutes(v1)
+	v1.HandleFunc("/undocumented", handleOpenAPI).Methods("GET")
+	if err := checkRouteContract(router, apiVersionPrefix); err == nil || !strings.Contains(err.Error(), "/undocumented") {
+		t.Fatalf("an undocumented route was not reported: %v", err)
+	}
+}
+
+// TestResponsesMatchOpenAPI exercises every REST operation and fails on any response the document does not describe
+func TestResponsesMatchOpenAPI(t *testing.T) {
+	var mu sync.Mutex
+	var drifted []string
+	report := reportResponseDrift
+	reportResponseDrift = func(r *http.Request, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		drifted = append(drifted, r.Method+" "+r.URL.Path+": "+err.Error())
+	}
+	defer func() { reportResponseDrift = report }()
+
+	check := func(method string, path string, user string, headers map[string]string, body string, want int) (*http.Response, []byte) {
+		t.Helper()
+		resp, data := apiRequest(t, method, path, user, headers, body)
+		expectStatus(t, resp, data, want)
+		return resp, data
+	}
+
+	id := createTestSession(t, "alice", `{"name":"contract","quorum":2}`)
+	session := "/v1/sessions/" + id
+	check("GET", "/v1/sessions", "alice", nil, "", http.StatusOK)
+	resp, _ := check("GET", session, "alice", nil, "", http.StatusOK)
+	check("GET", session, "alice", map[string]string{"If-None-Match": resp.Header.Get("ETag")}, "", http.StatusNotModified)
+	check("PATCH", "/v1/sessions", "bob", nil, `{"id":"`+id+`","vote":true}`, http.StatusOK)
+	check("PATCH", "/v1/sessions", "bob", nil, `{"id":"`+id+`","vote":false}`, http.StatusConflict)
+	resp, _ = check("GET", session, "alice", nil, "", http.StatusOK)
+	check("PUT", session, "alice", nil, `{"name":"renamed"}`, http.StatusPreconditionRequired)
+	resp, _ = check("PUT", session, "alice", map[string]string{"If-Match": resp.Header.Get("ETag")}, `{"name":"renamed","quorum":1}`, http.StatusOK)
+	check("GET", session+"/ballots", "", nil, "", http.StatusOK)
+	check("GET", session+"/chat", "alice", nil, "", http.StatusOK)
+
+	check("POST", "/v1/delegations", "carol", nil, `{"delegate":"bob","sessionId":"`+id+`"}`, http.StatusOK)
+	check("GET", "/v1/delegations?sessionId="+id, "carol", nil, "", http.StatusOK)
+	check("DELETE", "/v1/delegations", "carol", nil, `{"sessionId":"`+id+`"}`, http.StatusOK)
+
+	_, data := check("POST", "/v1/webhooks", "alice", nil, `{"url":"https://hooks.example.com/streakai","workspace":"contract"}`, http.StatusCreated)
+	var webhook Webhook
+	json.Unmarshal(data, &webhook)
+	check("GET", "/v1/webhooks", "alice", nil, "", http.StatusOK)
+	check("GET", "/v1/webhooks/"+webhook.Id+"/deliveries", "alice", nil, "", http.StatusOK)
+	check("POST", "/v1/webhooks/"+webhook.Id+"/enable", "alice", nil, "", http.StatusOK)
+	check("DELETE", "/v1/webhooks/"+webhook.Id, "alice", nil, "", http.StatusOK)
+
+	// the delegations above bumped the version
+	resp, _ = check("GET", session, "alice", nil, "", http.StatusOK)
+	check("POST", session+"/close", "alice", nil, "", http.StatusPreconditionRequired)
+	check("POST", session+"/close", "alice", map[string]string{"If-Match": resp.Header.Get("ETag")}, "", http.StatusOK)
+
+	_, data = check("POST", "/v1/bulk/sessions", "alice", nil, `{"template":{"name":"bulk"},"sessions":[{},{"mode":"dots"}]}`, http.StatusOK)
+	var bulk BulkResponse
+	json.Unmarshal(data, &bulk)
+	created := `{"ids":["` + bulk.Results[0].Id + `","missing"]}`
+	check("POST", "/v1/bulk/sessions/close", "alice", nil, created, http.StatusOK)
+	check("POST", "/v1/bulk/sessions/delete", "alice", nil, created, http.StatusOK)
+
+	check("GET", "/v1/openapi.json", "", nil, "", http.StatusOK)
+	check("GET", "/v1/schema/events.json", "", nil, "", http.StatusOK)
+	check("POST", "/v1/graphql", "alice", nil, `{"query":"{ me { username } }"}`, http.StatusOK)
+
+	check("GET", "/v1/sessions/missing", "alice", nil, "", http.StatusNotFound)
+	for method, path := range map[string]string{"GET": "/v1/nowhere", "PUT": "/v1/webhooks", "DELETE": "/v1/openapi.json", "PATCH": "/openapi.json"} {
+		want := http.StatusMethodNotAllowed
+		if path == "/v1/nowhere" {
+			want = http.StatusNotFound
+		}
+		resp, data := apiRequest(t, method, path, "alice", nil, "")
+		expectStatus(t, resp, data, want)
+		var apiError APIError
+		if err := json.Unmarshal(data, &apiError); err != nil || apiError.Code != errorCode(want) || apiError.RequestID == "" || apiError.RequestID != resp.Header.Get(requestIDHeader) {
+			t.Errorf("%s %s answered %s", method, path, data)
+		}
+		if want == http.StatusMethodNotAllowed && !strings.Contains(resp.Header.Get("Allow"), "GET") {
+			t.Errorf("%s %s allows %q", method, path, resp.Header.Get("Allow"))
+		}
+	}
+	check("GET", "/v1/sessions", "", nil, "", http.StatusUnauthorized)
+	check("POST", "/v1/sessions", "alice", nil, `{}`, http.StatusBadRequest)
+	resp, _ = check("GET", "/sessions", "alice", nil, "", http.StatusOK)
+	if resp.Header.Get("Deprecation") != "true" {
+		t.Errorf("unversioned alias is not marked deprecated")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, drift := range drifted {
+		t.Errorf("response drifted from openapi.yaml: %s", drift)
+	}
+}
+
+// TestSessionIntegersAreNumbers checks REST encodes version and closedAt as JSON numbers, as events and webhooks do
+func TestSessionIntegersAreNumbers(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"numbers"}`)
+	resp, data := apiRequest(t, http.MethodGet, "/v1/sessions/"+id, "alice", nil, "")
+	expectStatus(t, resp, data, http.StatusOK)
+	resp, data = apiRequest(t, http.MethodPost, "/v1/sessions/"+id+"/close", "alice", map[string]string{"If-Match": resp.Header.Get("ETag")}, "")
+	expectStatus(t, resp, data, http.StatusOK)
+	resp, data = apiRequest(t, http.MethodGet, "/v1/sessions/"+id, "alice", nil, "")
+	expectStatus(t, resp, data, http.StatusOK)
+
+	var session map[string]interface{}
+	if err := json.Unmarshal(data, &session); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"version", "closedAt"} {
+		if number, ok := session[field].(float64); !ok || number <= 0 {
+			t.Errorf("%s is %#v", field, session[field])
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// eventNudge reminds present users who have not voted yet, it is only sent to them
+const eventNudge = "session.nudge"
+
+// A connection stays present for presenceTTL after joining or after its replica's last heartbeat,
+// so the connections of a replica that stopped expire instead of staying present forever
+const (
+	presenceTTL       = 90 * time.Second
+	presenceHeartbeat = 30 * time.Second
+)
+
+// joinSession records that the client is viewing the session, announcing the user's arrival on their first connection
+func joinSession(sessionID string, client *Client) {
+	connections, err := addPresence(sessionID, client.id, client.username, time.Now().Add(presenceTTL))
+	if err != nil {
+		log.Printf("Error recording presence: %v", err)
+		return
+	}
+	if connections == 1 {
+		broadcastPresence(sessionID)
+	}
+}
+
+// leaveSessions records that the client closed its view of each session, announcing the user's departure from their last one
+func leaveSessions(sessionIDs []string, clientID string, username string) {
+	for _, sessionID := range sessionIDs {
+		connections, err := removePresence(sessionID, clientID, username)
+		if err != nil {
+			log.Printf("Error recording presence: %v", err)
+			continue
+		}
+		if connections == 0 {
+			broadcastPresence(sessionID)
+		}
+	}
+}
+
+// keepPresence refreshes the presence of this replica's clients every presenceHeartbeat, and expires the presence
+// of connections whose replica stopped refreshing it, announcing the users who left
+func keepPresence() {
+	for {
+		time.Sleep(presenceHeartbeat)
+		if err := refreshPresence(hub.presence(), time.Now().Add(presenceTTL)); err != nil {
+			log.Printf("Error refreshing presence: %v", err)
+		}
+		expireStalePresence()
+	}
+}
+
+// expireStalePresence removes expired connections from every session with presence
+func expireStalePresence() {
+	sessionIDs, err := getPresenceSessionIDs()
+	if err != nil {
+		log.Printf("Error expiring presence: %v", err)
+		return
+	}
+	for _, sessionID := range sessionIDs {
+		left, err := expirePresence(sessionID, time.Now())
+		if err != nil {
+			log.Printf("Error expiring presence: %v", err)
+			continue
+		}
+		if len(left) > 0 {
+			broadcastPresence(sessionID)
+		}
+		if err := forgetPresenceSession(sessionID); err != nil {
+			log.Printf("Error expiring presence: %v", err)
+		}
+	}
+}
+
+// sessionPresence lists who is connected to the session and which of them have not voted yet
+func sessionPresence(session *VotingSession) (*Presence, error) {
+	present, err := getPresentUsers(session.Id)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(present)
+
+	presence := &Presence{Present: present, NotVoted: []string{}}
+	for _, user := range present {
+		if !hasVoted(session, user) {
+			presence.NotVoted = append(presence.NotVoted, user)
+		}
+	}
+	return presence, nil
+}
+
+// hasVoted reports whether the user cast a vote in the session, whatever its mode
+func hasVoted(session *VotingSession, username string) bool {
+	if isOptionMode(session.Mode) {
+		_, ok := session.Allocations[username]
+		return ok
+	}
+	return alreadyVoted(session.YesCount, session.NoCount, username)
+}
+
+// broadcastPresence pushes the session's presence list to its subscribers
+func broadcastPresence(sessionID string) {
+	session, err := getSession(sessionID)
+	if err != nil {
+		log.Printf("Error loading session for presence: %v", err)
+		return
+	}
+	presence, err := sessionPresence(session)
+	if err != nil {
+		log.Printf("Error loading presence: %v", err)
+		return
+	}
+	seq, err := nextEventSeq(sessionID)
+	if err != nil {
+		log.Printf("Error building %s event: %v", eventPresenceChanged, err)
+		return
+	}
+
+	broadcastEvent(session, &Event{
+		Version:   eventVersion,
+		Type:      eventPresenceChanged,
+		SessionID: sessionID,
+		Seq:       seq,
+		Timestamp: time.Now().UTC(),
+		Payload:   presence,
+	})
+}
+
+// nudgeNonVoters lets the owner remind the present users who have not voted yet
+func nudgeNonVoters(username string, sessionID string) ([]string, error) {
+	session, err := getSession(sessionID)
+	if err != nil {
+		return nil, &statusError{status: http.StatusNotFound, message: "Session not found"}
+	}
+	if session.Owner != username {
+		return nil, &statusError{status: http.StatusForbidden, message: "Only the session owner can nudge voters"}
+	}
+	if session.Closed {
+		return nil, &statusError{status: http.StatusConflict, message: "Session is closed"}
+	}
+
+	presence, err := sessionPresence(session)
+	if err != nil {
+		return nil, err
+	}
+	if len(presence.NotVoted) == 0 {
+		return presence.NotVoted, nil
+	}
+
+	// nudges are not part of the session history, so like other events that are not buffered their seq is 0
+	data, err := json.Marshal(&Event{
+		Version:   eventVersion,
+		Type:      eventNudge,
+		SessionID: sessionID,
+		Timestamp: time.Now().UTC(),
+		Payload:   map[string]string{"from": username},
+	})
+	if err != nil {
+		return nil, err
+	}
+	publishEvent(BusMessage{SessionID: sessionID, Workspace: session.Workspace, Event: data, Recipients: presence.NotVoted})
+	return presence.NotVoted, nil
+}
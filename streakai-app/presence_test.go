@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPresenceIsPerConnection(t *testing.T) {
+	sessionID := createTestSession(t, "alice", `{"name":"presence"}`)
+	expiry := time.Now().Add(presenceTTL)
+
+	for want, clientID := range []string{"tab1", "tab2"} {
+		if connections, err := addPresence(sessionID, clientID, "bob", expiry); err != nil || connections != want+1 {
+			t.Fatalf("bob's %s: %d connections, %v", clientID, connections, err)
+		}
+	}
+	if connections, _ := addPresence(sessionID, "tab3", "chat:T1:bob", expiry); connections != 1 {
+		t.Errorf("a chat user sharing bob's name counted %d connections", connections)
+	}
+	if connections, _ := removePresence(sessionID, "tab1", "bob"); connections != 1 {
+		t.Errorf("bob has %d connections left after closing one", connections)
+	}
+	if connections, _ := removePresence(sessionID, "tab2", "bob"); connections != 0 {
+		t.Errorf("bob has %d connections left after closing both", connections)
+	}
+	if present, _ := getPresentUsers(sessionID); !reflect.DeepEqual(present, []string{"chat:T1:bob"}) {
+		t.Errorf("present %v", present)
+	}
+}
+
+func TestPresenceExpiresWithoutHeartbeat(t *testing.T) {
+	sessionID := createTestSession(t, "alice", `{"name":"stopped replica"}`)
+	past := time.Now().Add(-time.Second)
+	addPresence(sessionID, "lost", "carol", past)
+	addPresence(sessionID, "lost-too", "dave", past)
+	addPresence(sessionID, "open", "dave", time.Now().Add(presenceTTL))
+	addPresence(sessionID, "refreshed", "erin", past)
+
+	if present, _ := getPresentUsers(sessionID); !reflect.DeepEqual(present, []string{"dave"}) {
+		t.Errorf("expired connections are present: %v", present)
+	}
+	if err := refreshPresence(map[string][]string{sessionID: {presenceMember("refreshed", "erin")}}, time.Now().Add(presenceTTL)); err != nil {
+		t.Fatal(err)
+	}
+	left, err := expirePresence(sessionID, time.Now())
+	if err != nil || !reflect.DeepEqual(left, []string{"carol"}) {
+		t.Errorf("left %v, %v", left, err)
+	}
+	if left, _ := expirePresence(sessionID, time.Now()); len(left) != 0 {
+		t.Errorf("departures announced twice: %v", left)
+	}
+	present, _ := getPresentUsers(sessionID)
+	sort.Strings(present)
+	if !reflect.DeepEqual(present, []string{"dave", "erin"}) {
+		t.Errorf("present after expiring %v", present)
+	}
+	if ttl := redisClient.PTTL(presenceKey(sessionID)).Val(); ttl <= presenceTTL {
+		t.Errorf("presence expires in %v", ttl)
+	}
+}
+
+func TestNudgeIsNotReplayable(t *testing.T) {
+	sessionID := createTestSession(t, "alice", `{"name":"nudged"}`)
+	castTestVote(t, "bob", sessionID)
+	carol := subscribeTestClient(t, "carol", ClientMessage{SessionID: sessionID})
+	nextTestEvent(t, carol, eventPresenceChanged)
+
+	nudged, err := nudgeNonVoters("alice", sessionID)
+	if err != nil || !reflect.DeepEqual(nudged, []string{"carol"}) {
+		t.Fatalf("nudged %v, %v", nudged, err)
+	}
+	nudge := nextTestEvent(t, carol, eventNudge)
+	if nudge.Seq != 0 {
+		t.Errorf("the nudge has seq %d", nudge.Seq)
+	}
+
+	// Server-Sent Events only carry an id for events a reconnecting client can resume after
+	for data, want := range map[string]string{
+		`{"type":"session.nudge","seq":0}`: "event: session.nudge\n",
+		`{"type":"vote.cast","seq":7}`:     "id: 7\nevent: vote.cast\n",
+	} {
+		var frame bytes.Buffer
+		if err := writeSSE(&frame, []byte(data)); err != nil || !strings.HasPrefix(frame.String(), want) {
+			t.Errorf("%s was framed as %q, %v", data, frame.String(), err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/go-redis/redis"
+)
+
+// eventsChannel is the Redis pub/sub channel every replica publishes session events to
+const eventsChannel = "streakai:events"
+
+// publishEvent hands an event to every replica, falling back to local
+// delivery when Redis is unavailable so this replica's clients still get it
+func publishEvent(msg BusMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error encoding bus message: %v", err)
+		return
+	}
+
+	if err := redisClient.Publish(eventsChannel, data).Err(); err != nil {
+		log.Printf("Error publishing event to Redis, delivering locally: %v", err)
+		deliverLocally(msg)
+	}
+}
+
+// subscribeEvents fans out the events published by any replica to this replica's subscribers
+func subscribeEvents() {
+	if _, err := relayEvents(redisClient, hub); err != nil {
+		log.Fatalf("Error subscribing to %s: %v", eventsChannel, err)
+	}
+}
+
+// relayEvents subscribes to the events channel and queues every event for the hub's subscribers until the
+// returned subscription is closed
+func relayEvents(client *redis.Client, h *Hub) (*redis.PubSub, error) {
+	pubsub := client.Subscribe(eventsChannel)
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	go func() {
+		defer pubsub.Close()
+		for message := range pubsub.Channel() {
+			var msg BusMessage
+			if err := json.Unmarshal([]byte(message.Payload), &msg); err != nil {
+				log.Printf("Error decoding bus message: %v", err)
+				continue
+			}
+			h.publish(msg.SessionID, msg.Workspace, msg.Recipients, msg.Event)
+		}
+	}()
+	return pubsub, nil
+}
+
+// deliverLocally queues an event for the subscribers connected to this replica
+func deliverLocally(msg BusMessage) {
+	hub.publish(msg.SessionID, msg.Workspace, msg.Recipients, msg.Event)
+}
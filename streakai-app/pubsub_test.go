@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// startTestReplica relays the events of the shared Redis to a hub of its own, as another app replica would
+func startTestReplica(t *testing.T) *Hub {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: redisClient.Options().Addr})
+	h := newHub()
+	pubsub, err := relayEvents(client, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pubsub.Close()
+		client.Close()
+	})
+	return h
+}
+
+func TestEventsReachOtherReplicas(t *testing.T) {
+	replica := startTestReplica(t)
+	id := createTestSession(t, "alice", `{"name":"scaled out","workspace":"replicas"}`)
+	local := subscribeTestClient(t, "bob", ClientMessage{SessionID: id})
+	remote, watcher := newClient(nil, "carol", ""), newClient(nil, "dave", "")
+	for _, client := range []*Client{remote, watcher} {
+		replica.register(client)
+		defer replica.unregister(client)
+	}
+	replica.subscribe(remote, ClientMessage{SessionID: id})
+	replica.subscribe(watcher, ClientMessage{Workspace: "replicas"})
+
+	castTestVote(t, "erin", id)
+	for _, client := range []*Client{local, remote, watcher} {
+		if event := nextTestEvent(t, client, eventVoteCast); event.SessionID != id {
+			t.Errorf("%s received the vote of session %s", client.username, event.SessionID)
+		}
+	}
+
+	// events for some users only are delivered to them on every replica
+	if _, err := nudgeNonVoters("alice", id); err != nil {
+		t.Fatal(err)
+	}
+	nextTestEvent(t, remote, eventNudge)
+	// the reaction is published after the nudge, so the watcher has been sent everything before it
+	if err := react("erin", id, "👍"); err != nil {
+		t.Fatal(err)
+	}
+	for timeout := time.After(5 * time.Second); ; {
+		select {
+		case data := <-watcher.send:
+			event, err := decodeEvent(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Type == eventNudge {
+				t.Errorf("a nudge for others reached %s", watcher.username)
+			}
+			if event.Type == eventReaction {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("the reaction did not reach %s", watcher.username)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// quadraticCost returns the credits an allocation costs: k votes on an option cost k²
+func quadraticCost(allocation map[string]int) int {
+	cost := 0
+	for _, votes := range allocation {
+		cost += votes * votes
+	}
+	return cost
+}
+
+// quadraticCostWithin returns the cost of an allocation and whether it fits the budget. It stops counting
+// as soon as the budget is exceeded, so huge vote counts cannot overflow the sum.
+func quadraticCostWithin(allocation map[string]int, budget int) (int, bool) {
+	cost := 0
+	for _, votes := range allocation {
+		if votes < 0 {
+			votes = -votes
+		}
+		if votes > isqrt(budget-cost) {
+			return cost, false
+		}
+		cost += votes * votes
+	}
+	return cost, true
+}
+
+// isqrt returns the largest integer whose square is at most n, without squaring past the int range
+func isqrt(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	r := int(math.Sqrt(float64(n)))
+	for r > 0 && r > n/r {
+		r--
+	}
+	for r+1 <= n/(r+1) {
+		r++
+	}
+	return r
+}
+
+// allocationTotals sums the votes per option over all users, scaled by their weight when a session is given
+func allocationTotals(allocations map[string]map[string]int, session *VotingSession) map[string]float64 {
+	totals := make(map[string]float64)
+	for user, allocation := range allocations {
+		weight := 1.0
+		if session != nil {
+			weight = voterWeight(session, user)
+		}
+		for option, votes := range allocation {
+			if votes != 0 {
+				totals[option] += float64(votes) * weight
+			}
+		}
+	}
+	return totals
+}
+
+// remainingCredits returns the unspent credits of every user who has voted in a quadratic session
+func remainingCredits(session *VotingSession) map[string]int {
+	remaining := make(map[string]int)
+	for user, allocation := range session.Allocations {
+		remaining[user] = session.Credits - quadraticCost(allocation)
+	}
+	return remaining
+}
+
+// validateOptions checks that a session offering options lists each of them once
+func validateOptions(options []string) error {
+	if len(options) == 0 {
+		return fmt.Errorf("at least one option is required")
+	}
+	seen := make(map[string]bool)
+	for _, option := range options {
+		if option == "" || seen[option] {
+			return fmt.Errorf("options must be unique and non-empty")
+		}
+		seen[option] = true
+	}
+	return nil
+}
+
+// castQuadraticVote merges the requested votes into the user's allocation,
+// enforcing that its total quadratic cost stays within the session's credit budget
+func castQuadraticVote(session *VotingSession, username string, request map[string]int) (*Ballot, error) {
+	if len(request) == 0 {
+		return nil, &statusError{status: http.StatusBadRequest, message: "An allocation of votes per option is required"}
+	}
+
+	allocation := make(map[string]int)
+	for option, votes := range session.Allocations[username] {
+		allocation[option] = votes
+	}
+	for option, votes := range request {
+		if !hasOption(session, option) {
+			return nil, &statusError{status: http.StatusBadRequest, message: "Unknown option " + option}
+		}
+		if votes < 0 {
+			return nil, &statusError{status: http.StatusBadRequest, message: "Votes must not be negative"}
+		}
+		// checked before squaring, votes² alone would wrap for counts past 3037000499
+		if votes > isqrt(session.Credits) {
+			return nil, &statusError{status: http.StatusUnprocessableEntity,
+				message: fmt.Sprintf("%d votes on %s cost more than the %d credits available", votes, option, session.Credits)}
+		}
+		allocation[option] = votes
+	}
+
+	if _, ok := quadraticCostWithin(allocation, session.Credits); !ok {
+		return nil, &statusError{status: http.StatusUnprocessableEntity,
+			message: fmt.Sprintf("Allocation costs more than the %d credits available", session.Credits)}
+	}
+
+	ballot, err := nextBallot(session, username, false, allocation)
+	if err != nil {
+		return nil, err
+	}
+	if session.Allocations == nil {
+		session.Allocations = make(map[string]map[string]int)
+	}
+	session.Allocations[username] = allocation
+	return ballot, nil
+}
+
+// hasOption reports whether the session offers the option
+func hasOption(session *VotingSession, option string) bool {
+	for _, o := range session.Options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"testing"
+)
+
+// allocate casts an allocation of votes or dots of the user, expecting the status
+func allocate(t *testing.T, user string, id string, allocation string, want int) {
+	t.Helper()
+	resp, data := apiRequest(t, http.MethodPatch, "/v1/sessions", user, nil, `{"id":"`+id+`","allocation":`+allocation+`}`)
+	expectStatus(t, resp, data, want)
+}
+
+func TestQuadraticBudget(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"roadmap","mode":"quadratic","options":["search","export"],"credits":10}`)
+	allocate(t, "bob", id, `{"search":3}`, http.StatusOK)
+	allocate(t, "bob", id, `{"export":1}`, http.StatusOK)
+	allocate(t, "bob", id, `{"export":2}`, http.StatusUnprocessableEntity)
+	allocate(t, "bob", id, `{"search":4}`, http.StatusUnprocessableEntity)
+	allocate(t, "bob", id, `{"import":1}`, http.StatusBadRequest)
+	allocate(t, "carol", id, `{"search":1,"export":1}`, http.StatusOK)
+
+	resp, data := apiRequest(t, http.MethodGet, "/v1/sessions/"+id, "alice", nil, "")
+	expectStatus(t, resp, data, http.StatusOK)
+	var session struct {
+		Tally            Tally          `json:"tally"`
+		RemainingCredits map[string]int `json:"remainingCredits"`
+	}
+	if err := json.Unmarshal(data, &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.RemainingCredits["bob"] != 0 || session.RemainingCredits["carol"] != 8 {
+		t.Errorf("remaining credits %v", session.RemainingCredits)
+	}
+	if session.Tally.Options["search"] != 4 || session.Tally.Options["export"] != 2 {
+		t.Errorf("quadratic tally %v", session.Tally.Options)
+	}
+}
+
+func TestQuadraticCostDoesNotOverflow(t *testing.T) {
+	session := &VotingSession{Mode: modeQuadratic, Options: []string{"a", "b"}, Credits: math.MaxInt32}
+	// 3037000500² wraps past the int64 range
+	for _, allocation := range []map[string]int{{"a": 3037000500}, {"a": 46341}, {"a": 40000, "b": 40000}} {
+		if _, err := castQuadraticVote(session, "bob", allocation); err == nil || err.(*statusError).status != http.StatusUnprocessableEntity {
+			t.Errorf("%v was accepted: %v", allocation, err)
+		}
+	}
+	if _, ok := quadraticCostWithin(map[string]int{"a": math.MaxInt64, "b": math.MinInt64 + 1}, math.MaxInt32); ok {
+		t.Errorf("an overflowing allocation fits the budget")
+	}
+	if cost, ok := quadraticCostWithin(map[string]int{"a": 46340}, math.MaxInt32); !ok || cost != 46340*46340 {
+		t.Errorf("46340 votes cost %d, %t", cost, ok)
+	}
+}
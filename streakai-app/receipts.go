@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ballotGenesis returns the hash the first ballot of a session chains to
+func ballotGenesis(sessionID string) string {
+	sum := sha256.Sum256([]byte("streakai:" + sessionID))
+	return hex.EncodeToString(sum[:])
+}
+
+// ballotTagKey is the server-held key voter tags are computed with, so usernames cannot be guessed back from them
+var ballotTagKey []byte
+
+// initBallotTagKey uses the configured key, or else the one shared through Redis, generated on first start
+func initBallotTagKey(configured string) error {
+	if configured != "" {
+		ballotTagKey = []byte(configured)
+		return nil
+	}
+	log.Printf("BALLOT_TAG_KEY is not set, using the ballot tag key shared through Redis")
+	candidate := make([]byte, 32)
+	if _, err := rand.Read(candidate); err != nil {
+		return fmt.Errorf("failed to generate ballot tag key: %v", err)
+	}
+	key, err := getBallotTagKey(hex.EncodeToString(candidate))
+	if err != nil {
+		return err
+	}
+	ballotTagKey = []byte(key)
+	return nil
+}
+
+// voterTag hides the username behind a per-session HMAC so the published chain
+// does not reveal who voted while still letting a voter recognise their ballot
+// from their receipt. Without the key a tag cannot be checked against a list of usernames.
+func voterTag(sessionID string, username string) string {
+	mac := hmac.New(sha256.New, ballotTagKey)
+	mac.Write([]byte(sessionID + ":" + username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashBallot computes the chained hash of a ballot.
+// hash = sha256(seq|prevHash|voter|vote|timestamp), with |option=k,... appended for allocation ballots
+func hashBallot(b Ballot) string {
+	data := fmt.Sprintf("%d|%s|%s|%t|%d", b.Seq, b.PrevHash, b.Voter, b.Vote, b.Timestamp)
+	if len(b.Allocation) > 0 {
+		options := make([]string, 0, len(b.Allocation))
+		for option := range b.Allocation {
+			options = append(options, option)
+		}
+		sort.Strings(options)
+		parts := make([]string, len(options))
+		for i, option := range options {
+			parts[i] = fmt.Sprintf("%s=%d", option, b.Allocation[option])
+		}
+		data += "|" + strings.Join(parts, ",")
+	}
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// nextBallot builds the user's ballot chained to the head of the session's ballot log, and moves the session's head
+// to it. It is appended by commitBallot together with the session. Allocation ballots carry the user's complete
+// allocation, superseding their earlier ones.
+func nextBallot(session *VotingSession, username string, vote bool, allocation map[string]int) (*Ballot, error) {
+	ballots, err := getBallots(session.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	prevHash := ballotGenesis(session.Id)
+	if len(ballots) > 0 {
+		prevHash = ballots[len(ballots)-1].Hash
+	}
+
+	ballot := Ballot{
+		Seq:        len(ballots) + 1,
+		PrevHash:   prevHash,
+		Voter:      voterTag(session.Id, username),
+		Vote:       vote,
+		Allocation: allocation,
+		Timestamp:  time.Now().Unix(),
+	}
+	ballot.Hash = hashBallot(ballot)
+	session.BallotHead = ballot.Hash
+	return &ballot, nil
+}
+
+// verifyBallots recomputes the chain and the tally it commits to.
+// It returns the index of the first broken ballot, or -1 if the chain is intact.
+func verifyBallots(sessionID string, ballots []Ballot) (Tally, int) {
+	var tally Tally
+	// a voter's latest ballot supersedes their earlier ones
+	votes := make(map[string]bool)
+	allocations := make(map[string]map[string]int)
+	prevHash := ballotGenesis(sessionID)
+	for i, b := range ballots {
+		if b.Seq != i+1 || b.PrevHash != prevHash || hashBallot(b) != b.Hash {
+			return tally, i
+		}
+		if b.Allocation != nil {
+			allocations[b.Voter] = b.Allocation
+		} else {
+			votes[b.Voter] = b.Vote
+		}
+		prevHash = b.Hash
+	}
+	for _, vote := range votes {
+		if vote {
+			tally.Yes++
+		} else {
+			tally.No++
+		}
+	}
+	if len(allocations) > 0 {
+		tally.Options = allocationTotals(allocations, nil)
+	}
+	return tally, -1
+}
+
+// tallyMatches reports whether the tally recomputed from the ballot chain matches the stored session
+func tallyMatches(session *VotingSession, tally Tally) bool {
+	if int(tally.Yes) != len(session.YesCount) || int(tally.No) != len(session.NoCount) {
+		return false
+	}
+	stored := allocationTotals(session.Allocations, nil)
+	if len(stored) != len(tally.Options) {
+		return false
+	}
+	for option, total := range stored {
+		if tally.Options[option] != total {
+			return false
+		}
+	}
+	return true
+}
+
+// getBallotsHandler publishes the ballot hash chain of a session so anyone can verify it
+func getBallotsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+
+	session, err := getSession(sessionID)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	ballots, err := getBallots(sessionID)
+	if err != nil {
+		log.Printf("Error loading ballots: %v", err)
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tally, broken := verifyBallots(sessionID, ballots)
+	head := ballotGenesis(sessionID)
+	if len(ballots) > 0 {
+		head = ballots[len(ballots)-1].Hash
+	}
+	// the stored session must commit to the same chain head and tally
+	committed := session.BallotHead == head || (session.BallotHead == "" && len(ballots) == 0)
+	counted := tallyMatches(session, tally)
+
+	SendResponse(w, http.StatusOK, BallotLog{
+		SessionID: sessionID,
+		Genesis:   ballotGenesis(sessionID),
+		Head:      head,
+		Ballots:   ballots,
+		Tally:     tally,
+		Valid:     broken == -1 && committed && counted,
+	})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestVoterTagIsKeyed(t *testing.T) {
+	key := ballotTagKey
+	defer func() { ballotTagKey = key }()
+
+	tag := voterTag("session", "alice")
+	plain := sha256.Sum256([]byte("session:alice"))
+	if tag == hex.EncodeToString(plain[:]) {
+		t.Errorf("the voter tag is an unkeyed hash of the username")
+	}
+
+	// instances without a configured key share the one stored in Redis
+	if err := initBallotTagKey(""); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ballotTagKey, key) || voterTag("session", "alice") != tag {
+		t.Errorf("the stored ballot tag key changed")
+	}
+	if err := initBallotTagKey("configured"); err != nil {
+		t.Fatal(err)
+	}
+	if voterTag("session", "alice") == tag {
+		t.Errorf("the configured key was not used")
+	}
+}
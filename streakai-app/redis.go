@@ -2,8 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis"
 )
@@ -21,34 +26,923 @@ func initRedis() {
 	}
 }
 
+// errSessionNotFound is returned by getSession when no session has the ID
+var errSessionNotFound = errors.New("session not found")
+
 func getSession(sessionID string) (*VotingSession, error) {
 	sessionData, err := redisClient.Get(sessionID).Result()
 	if err == redis.Nil {
-		return nil, fmt.Errorf("session not found")
+		return nil, errSessionNotFound
 	} else if err != nil {
 		return nil, fmt.Errorf("failed to get session from Redis: %v", err)
 	}
 
 	var session VotingSession
-	if err := json.Unmarshal([]byte(sessionData), &session); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal session data: %v", err)
+	if err := json.Unmarshal([]byte(sessionData), &session); err != nil || session.Id != sessionID {
+		// another kind of record, not a session
+		return nil, errSessionNotFound
 	}
 
 	return &session, nil
 }
 
-func setSession(session *VotingSession) error {
+// insertSession stores a new session at version 1, watching its key so an existing session is never overwritten
+func insertSession(session *VotingSession) error {
 	sessionMutex.Lock()
 	defer sessionMutex.Unlock()
-	sessions = append(sessions, session)
+	session.Version = 1
 	sessionData, err := json.Marshal(session)
 	if err != nil {
 		return fmt.Errorf("failed to marshal session: %v", err)
 	}
 
-	if err := redisClient.Set(session.Id, sessionData, 0).Err(); err != nil {
+	err = redisClient.Watch(func(tx *redis.Tx) error {
+		exists, err := tx.Exists(session.Id).Result()
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return &statusError{status: http.StatusConflict, message: "session already exists"}
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			writeSession(pipe, session, sessionData)
+			return nil
+		})
+		return err
+	}, session.Id)
+	if se, ok := err.(*statusError); ok {
+		return se
+	} else if err != nil {
 		return fmt.Errorf("failed to set session in Redis: %v", err)
 	}
+	cacheSession(session)
+	return nil
+}
+
+// setSessionIfVersion stores the session only if the stored one is still at the given version,
+// watching its key so a write by any replica in between fails the update with 412
+func setSessionIfVersion(session *VotingSession, version int64) error {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	session.Version = version + 1
+	sessionData, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %v", err)
+	}
+
+	err = redisClient.Watch(func(tx *redis.Tx) error {
+		stored, err := storedVersion(tx, session.Id)
+		if err != nil {
+			return err
+		}
+		if stored != version {
+			return errVersionConflict
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			writeSession(pipe, session, sessionData)
+			return nil
+		})
+		return err
+	}, session.Id)
+	if err == redis.TxFailedErr {
+		return errVersionConflict
+	} else if err == errVersionConflict {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to set session in Redis: %v", err)
+	}
+	cacheSession(session)
+	return nil
+}
+
+// storedVersion reads the version of the stored session inside a transaction
+func storedVersion(tx *redis.Tx, sessionID string) (int64, error) {
+	storedData, err := tx.Get(sessionID).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get session from Redis: %v", err)
+	}
+	var stored VotingSession
+	if err := json.Unmarshal([]byte(storedData), &stored); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal session data: %v", err)
+	}
+	return stored.Version, nil
+}
+
+// writeSession queues the commands storing a session and its indexes, voters are indexed by commitBallot
+func writeSession(pipe redis.Pipeliner, session *VotingSession, sessionData []byte) {
+	pipe.Set(session.Id, sessionData, 0)
+	pipe.SAdd(allSessionsKey, session.Id)
+	if session.Workspace != "" {
+		pipe.SAdd(workspaceSessionsKey(session.Workspace), session.Id)
+	}
+	if session.Owner != "" {
+		pipe.SAdd(ownedSessionsKey(session.Owner), session.Id)
+	}
+}
+
+// cacheSession replaces the in-memory copy of a session, sessionMutex must be held
+func cacheSession(session *VotingSession) {
+	for i, existing := range sessions {
+		if existing.Id == session.Id {
+			sessions = append(sessions[:i], sessions[i+1:]...)
+			break
+		}
+	}
+	sessions = append(sessions, session)
+}
+
+func ballotsKey(sessionID string) string {
+	return "ballots:" + sessionID
+}
+
+func getBallots(sessionID string) ([]Ballot, error) {
+	entries, err := redisClient.LRange(ballotsKey(sessionID), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ballots from Redis: %v", err)
+	}
+
+	ballots := make([]Ballot, 0, len(entries))
+	for _, entry := range entries {
+		var ballot Ballot
+		if err := json.Unmarshal([]byte(entry), &ballot); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal ballot: %v", err)
+		}
+		ballots = append(ballots, ballot)
+	}
+
+	return ballots, nil
+}
+
+// commitBallot appends the username's ballot to the session's chain and stores the session in one transaction. The chain
+// and the session are watched, so a ballot appended or a session edited by any replica since this one was loaded fails
+// the commit with errBallotConflict instead of forking the chain or overwriting the edit.
+func commitBallot(session *VotingSession, ballot *Ballot, username string) error {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	ballotData, err := json.Marshal(ballot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ballot: %v", err)
+	}
+	version := session.Version
+	session.Version++
+	sessionData, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %v", err)
+	}
+
+	key := ballotsKey(session.Id)
+	err = redisClient.Watch(func(tx *redis.Tx) error {
+		length, err := tx.LLen(key).Result()
+		if err != nil {
+			return fmt.Errorf("failed to get ballots from Redis: %v", err)
+		}
+		if int(length) != ballot.Seq-1 {
+			return errBallotConflict
+		}
+		stored, err := storedVersion(tx, session.Id)
+		if err != nil {
+			return err
+		}
+		if stored != version {
+			return errBallotConflict
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.RPush(key, ballotData)
+			writeSession(pipe, session, sessionData)
+			pipe.SAdd(votedSessionsKey(username), session.Id)
+			return nil
+		})
+		return err
+	}, session.Id, key)
+	if err == redis.TxFailedErr || err == errBallotConflict {
+		return errBallotConflict
+	} else if err != nil {
+		return fmt.Errorf("failed to append ballot in Redis: %v", err)
+	}
+	cacheSession(session)
+	return nil
+}
+
+func sessionDelegationsKey(sessionID string) string {
+	return "delegations:session:" + sessionID
+}
+
+func workspaceDelegationsKey(workspace string) string {
+	return "delegations:workspace:" + workspace
+}
+
+func getDelegations(key string) (map[string]string, error) {
+	delegations, err := redisClient.HGetAll(key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get delegations from Redis: %v", err)
+	}
+	return delegations, nil
+}
+
+func setDelegation(key string, from string, to string) error {
+	if err := redisClient.HSet(key, from, to).Err(); err != nil {
+		return fmt.Errorf("failed to set delegation in Redis: %v", err)
+	}
+	return nil
+}
+
+func removeDelegation(key string, from string) error {
+	if err := redisClient.HDel(key, from).Err(); err != nil {
+		return fmt.Errorf("failed to remove delegation from Redis: %v", err)
+	}
+	return nil
+}
+
+// allSessionsKey indexes the IDs of every stored session
+const allSessionsKey = "sessions"
+
+func getAllSessionIDs() ([]string, error) {
+	ids, err := redisClient.SMembers(allSessionsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions from Redis: %v", err)
+	}
+	return ids, nil
+}
+
+func workspaceSessionsKey(workspace string) string {
+	return "workspace:" + workspace + ":sessions"
+}
+
+func getWorkspaceSessionIDs(workspace string) ([]string, error) {
+	ids, err := redisClient.SMembers(workspaceSessionsKey(workspace)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace sessions from Redis: %v", err)
+	}
+	return ids, nil
+}
+
+// ownedSessionsKey indexes the sessions a user owns, so listing them does not scan every session
+func ownedSessionsKey(username string) string {
+	return "user:" + username + ":sessions:owned"
+}
+
+// votedSessionsKey indexes the sessions a user voted in
+func votedSessionsKey(username string) string {
+	return "user:" + username + ":sessions:voted"
+}
+
+func getUserSessionIDs(key string) ([]string, error) {
+	ids, err := redisClient.SMembers(key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user sessions from Redis: %v", err)
+	}
+	return ids, nil
+}
+
+// userIndexesKey marks that the sessions stored before the owner and voter indexes existed were added to them
+const userIndexesKey = "sessions:user-indexes"
+
+// indexUserSessions adds every listed session to the indexes of its owner and voters once
+func indexUserSessions() error {
+	indexed, err := redisClient.Exists(userIndexesKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to check user indexes in Redis: %v", err)
+	}
+	if indexed > 0 {
+		return nil
+	}
+	ids, err := getAllSessionIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		session, err := getSession(id)
+		if err != nil {
+			log.Printf("Error loading session %s: %v", id, err)
+			continue
+		}
+		pipe := redisClient.Pipeline()
+		if session.Owner != "" {
+			pipe.SAdd(ownedSessionsKey(session.Owner), session.Id)
+		}
+		for _, voter := range sessionVoters(session) {
+			pipe.SAdd(votedSessionsKey(voter), session.Id)
+		}
+		if _, err := pipe.Exec(); err != nil {
+			return fmt.Errorf("failed to index user sessions in Redis: %v", err)
+		}
+	}
+	if err := redisClient.Set(userIndexesKey, time.Now().Unix(), 0).Err(); err != nil {
+		return fmt.Errorf("failed to mark user indexes in Redis: %v", err)
+	}
+	return nil
+}
+
+// ballotTagKeyName holds the key voter tags are keyed with when BALLOT_TAG_KEY is not set
+const ballotTagKeyName = "secrets:ballot-tag-key"
+
+// getBallotTagKey returns the stored voter tag key, storing candidate first when there is none yet so every
+// instance sharing the Redis uses the same key
+func getBallotTagKey(candidate string) (string, error) {
+	if err := redisClient.SetNX(ballotTagKeyName, candidate, 0).Err(); err != nil {
+		return "", fmt.Errorf("failed to set ballot tag key in Redis: %v", err)
+	}
+	key, err := redisClient.Get(ballotTagKeyName).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to get ballot tag key from Redis: %v", err)
+	}
+	return key, nil
+}
+
+func eventSeqKey(sessionID string) string {
+	return "events:" + sessionID + ":seq"
+}
+
+func nextEventSeq(sessionID string) (int64, error) {
+	seq, err := redisClient.Incr(eventSeqKey(sessionID)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to increment event sequence in Redis: %v", err)
+	}
+	return seq, nil
+}
+
+func currentEventSeq(sessionID string) (int64, error) {
+	seq, err := redisClient.Get(eventSeqKey(sessionID)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get event sequence from Redis: %v", err)
+	}
+	return seq, nil
+}
+
+func eventLogKey(sessionID string) string {
+	return "events:" + sessionID + ":log"
+}
+
+// appendEventLog buffers an event, keeping only the latest eventReplayLimit of them
+func appendEventLog(sessionID string, data []byte) error {
+	pipe := redisClient.Pipeline()
+	pipe.RPush(eventLogKey(sessionID), data)
+	pipe.LTrim(eventLogKey(sessionID), -eventReplayLimit, -1)
+	if _, err := pipe.Exec(); err != nil {
+		return fmt.Errorf("failed to buffer event in Redis: %v", err)
+	}
+	return nil
+}
+
+func getEventLog(sessionID string) ([]string, error) {
+	entries, err := redisClient.LRange(eventLogKey(sessionID), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get event log from Redis: %v", err)
+	}
+	return entries, nil
+}
+
+// presenceKey orders the connections viewing a session, members <client-id>:<username>, by the unix millisecond
+// time they expire unless their heartbeat refreshes them
+func presenceKey(sessionID string) string {
+	return "presence:connections:" + sessionID
+}
+
+// presenceKeyTTL drops the presence of a session once no replica has refreshed it for a while,
+// it outlives every expiry so a refresh by one replica never drops the connections of another
+const presenceKeyTTL = 2 * presenceTTL
+
+// presenceSessionsKey indexes the sessions with connections, for sweeping those that expired
+const presenceSessionsKey = "presence:sessions"
+
+func presenceMember(clientID string, username string) string {
+	return clientID + ":" + username
+}
+
+// presenceUser returns the username of a presence member, client IDs contain no ':'
+func presenceUser(member string) string {
+	_, username, _ := strings.Cut(member, ":")
+	return username
+}
+
+// countConnections counts the live connections of the user among presence members
+func countConnections(members []string, username string) int {
+	connections := 0
+	for _, member := range members {
+		if presenceUser(member) == username {
+			connections++
+		}
+	}
+	return connections
+}
+
+// addPresence records a connection of the user until it expires and returns the user's live connections
+func addPresence(sessionID string, clientID string, username string, expiry time.Time) (int, error) {
+	key := presenceKey(sessionID)
+	var live *redis.StringSliceCmd
+	_, err := redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(key, redis.Z{Score: float64(expiry.UnixMilli()), Member: presenceMember(clientID, username)})
+		pipe.PExpire(key, presenceKeyTTL)
+		pipe.SAdd(presenceSessionsKey, sessionID)
+		live = pipe.ZRangeByScore(key, livePresence(time.Now()))
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update presence in Redis: %v", err)
+	}
+	return countConnections(live.Val(), username), nil
+}
+
+// removePresence drops a connection and returns the user's live connections left
+func removePresence(sessionID string, clientID string, username string) (int, error) {
+	var live *redis.StringSliceCmd
+	_, err := redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZRem(presenceKey(sessionID), presenceMember(clientID, username))
+		live = pipe.ZRangeByScore(presenceKey(sessionID), livePresence(time.Now()))
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update presence in Redis: %v", err)
+	}
+	return countConnections(live.Val(), username), nil
+}
+
+// refreshPresence extends the expiry of open connections, adding back any a sweep removed while this replica stalled
+func refreshPresence(connections map[string][]string, expiry time.Time) error {
+	if len(connections) == 0 {
+		return nil
+	}
+	pipe := redisClient.Pipeline()
+	for sessionID, members := range connections {
+		for _, member := range members {
+			pipe.ZAdd(presenceKey(sessionID), redis.Z{Score: float64(expiry.UnixMilli()), Member: member})
+		}
+		pipe.PExpire(presenceKey(sessionID), presenceKeyTTL)
+		pipe.SAdd(presenceSessionsKey, sessionID)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return fmt.Errorf("failed to refresh presence in Redis: %v", err)
+	}
+	return nil
+}
+
+// expirePresence removes the connections of a session that stopped refreshing, such as those of a replica that
+// stopped, and returns the users this call found without a live connection left
+func expirePresence(sessionID string, now time.Time) ([]string, error) {
+	key := presenceKey(sessionID)
+	expired, err := redisClient.ZRangeByScore(key, redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(now.UnixMilli(), 10)}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get presence from Redis: %v", err)
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
 
+	removed := make([]*redis.IntCmd, len(expired))
+	var live *redis.StringSliceCmd
+	_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for i, member := range expired {
+			removed[i] = pipe.ZRem(key, member)
+		}
+		live = pipe.ZRangeByScore(key, livePresence(now))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire presence in Redis: %v", err)
+	}
+
+	var left []string
+	for i, member := range expired {
+		// another replica sweeping at the same time removed it first and announces it
+		username := presenceUser(member)
+		if removed[i].Val() == 1 && countConnections(live.Val(), username) == 0 && !containsUser(left, username) {
+			left = append(left, username)
+		}
+	}
+	return left, nil
+}
+
+func livePresence(now time.Time) redis.ZRangeBy {
+	return redis.ZRangeBy{Min: "(" + strconv.FormatInt(now.UnixMilli(), 10), Max: "+inf"}
+}
+
+func getPresenceSessionIDs() ([]string, error) {
+	ids, err := redisClient.SMembers(presenceSessionsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get presence from Redis: %v", err)
+	}
+	return ids, nil
+}
+
+// forgetPresenceSession drops a session without connections from the sweep
+func forgetPresenceSession(sessionID string) error {
+	err := redisClient.Watch(func(tx *redis.Tx) error {
+		connections, err := tx.ZCard(presenceKey(sessionID)).Result()
+		if err != nil || connections > 0 {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.SRem(presenceSessionsKey, sessionID)
+			return nil
+		})
+		return err
+	}, presenceKey(sessionID))
+	if err != nil && err != redis.TxFailedErr {
+		return fmt.Errorf("failed to update presence in Redis: %v", err)
+	}
+	return nil
+}
+
+// getPresentUsers returns the users with a live connection to the session
+func getPresentUsers(sessionID string) ([]string, error) {
+	members, err := redisClient.ZRangeByScore(presenceKey(sessionID), livePresence(time.Now())).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get presence from Redis: %v", err)
+	}
+	users := make([]string, 0, len(members))
+	seen := make(map[string]bool, len(members))
+	for _, member := range members {
+		if username := presenceUser(member); !seen[username] {
+			seen[username] = true
+			users = append(users, username)
+		}
+	}
+	return users, nil
+}
+
+func chatKey(sessionID string) string {
+	return "chat:" + sessionID
+}
+
+func mutedKey(sessionID string) string {
+	return "chat:" + sessionID + ":muted"
+}
+
+func appendChatMessage(sessionID string, message *ChatMessage) error {
+	messageData, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chat message: %v", err)
+	}
+
+	if err := redisClient.RPush(chatKey(sessionID), messageData).Err(); err != nil {
+		return fmt.Errorf("failed to append chat message in Redis: %v", err)
+	}
+	return nil
+}
+
+func getChatMessages(sessionID string) ([]ChatMessage, error) {
+	entries, err := redisClient.LRange(chatKey(sessionID), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chat from Redis: %v", err)
+	}
+
+	messages := make([]ChatMessage, 0, len(entries))
+	for _, entry := range entries {
+		var message ChatMessage
+		if err := json.Unmarshal([]byte(entry), &message); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal chat message: %v", err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// removeChatMessage deletes a message by ID and reports whether it existed
+func removeChatMessage(sessionID string, messageID string) (bool, error) {
+	entries, err := redisClient.LRange(chatKey(sessionID), 0, -1).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to get chat from Redis: %v", err)
+	}
+
+	for _, entry := range entries {
+		var message ChatMessage
+		if err := json.Unmarshal([]byte(entry), &message); err != nil {
+			continue
+		}
+		if message.Id == messageID {
+			if err := redisClient.LRem(chatKey(sessionID), 1, entry).Err(); err != nil {
+				return false, fmt.Errorf("failed to remove chat message from Redis: %v", err)
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func setUserMuted(sessionID string, username string, muted bool) error {
+	var err error
+	if muted {
+		err = redisClient.SAdd(mutedKey(sessionID), username).Err()
+	} else {
+		err = redisClient.SRem(mutedKey(sessionID), username).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update muted users in Redis: %v", err)
+	}
+	return nil
+}
+
+func isMuted(sessionID string, username string) (bool, error) {
+	muted, err := redisClient.SIsMember(mutedKey(sessionID), username).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to get muted users from Redis: %v", err)
+	}
+	return muted, nil
+}
+
+// incrementRateCounterScript counts and starts the window in one step, so a counter never outlives its window,
+// also expiring counters left without one
+var incrementRateCounterScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 or redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return count`)
+
+// incrementRateCounter counts an action in a fixed window and returns the count so far
+func incrementRateCounter(kind string, sessionID string, username string, window time.Duration) (int64, error) {
+	key := "ratelimit:" + kind + ":" + sessionID + ":" + username
+	count, err := incrementRateCounterScript.Run(redisClient, []string{key}, window.Milliseconds()).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count %s rate in Redis: %v", kind, err)
+	}
+	return count, nil
+}
+
+func webhookKey(id string) string {
+	return "webhook:" + id
+}
+
+func sessionWebhooksKey(sessionID string) string {
+	return "webhooks:session:" + sessionID
+}
+
+func workspaceWebhooksKey(workspace string) string {
+	return "webhooks:workspace:" + workspace
+}
+
+func userWebhooksKey(username string) string {
+	return "webhooks:user:" + username
+}
+
+// webhookScopeKey returns the index set of the session or workspace a webhook listens to
+func webhookScopeKey(webhook *Webhook) string {
+	if webhook.SessionID != "" {
+		return sessionWebhooksKey(webhook.SessionID)
+	}
+	return workspaceWebhooksKey(webhook.Workspace)
+}
+
+func getWebhook(id string) (*Webhook, error) {
+	data, err := redisClient.Get(webhookKey(id)).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("webhook not found")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get webhook from Redis: %v", err)
+	}
+
+	var webhook Webhook
+	if err := json.Unmarshal([]byte(data), &webhook); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal webhook: %v", err)
+	}
+	return &webhook, nil
+}
+
+// setWebhook stores a webhook and indexes it by its scope and owner
+func setWebhook(webhook *Webhook) error {
+	data, err := json.Marshal(webhook)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook: %v", err)
+	}
+
+	pipe := redisClient.TxPipeline()
+	pipe.Set(webhookKey(webhook.Id), data, 0)
+	pipe.SAdd(webhookScopeKey(webhook), webhook.Id)
+	pipe.SAdd(userWebhooksKey(webhook.Owner), webhook.Id)
+	if _, err := pipe.Exec(); err != nil {
+		return fmt.Errorf("failed to set webhook in Redis: %v", err)
+	}
+	return nil
+}
+
+// removeWebhook deletes a webhook with its indexes and delivery log
+func removeWebhook(webhook *Webhook) error {
+	pipe := redisClient.TxPipeline()
+	pipe.Del(webhookKey(webhook.Id), webhookDeliveriesKey(webhook.Id), webhookDeliveryOrderKey(webhook.Id), webhookFailuresKey(webhook.Id))
+	pipe.SRem(webhookScopeKey(webhook), webhook.Id)
+	pipe.SRem(userWebhooksKey(webhook.Owner), webhook.Id)
+	if _, err := pipe.Exec(); err != nil {
+		return fmt.Errorf("failed to remove webhook from Redis: %v", err)
+	}
+	return nil
+}
+
+func getWebhookIDs(key string) ([]string, error) {
+	ids, err := redisClient.SMembers(key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhooks from Redis: %v", err)
+	}
+	return ids, nil
+}
+
+func webhookDeliveriesKey(webhookID string) string {
+	return "webhook:" + webhookID + ":deliveries"
+}
+
+func webhookDeliveryOrderKey(webhookID string) string {
+	return "webhook:" + webhookID + ":deliveries:order"
+}
+
+func webhookFailuresKey(webhookID string) string {
+	return "webhook:" + webhookID + ":failures"
+}
+
+// saveWebhookDelivery stores a delivery, keeping only the latest webhookDeliveryLimit of a webhook
+func saveWebhookDelivery(delivery *WebhookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook delivery: %v", err)
+	}
+
+	isNew, err := redisClient.HSet(webhookDeliveriesKey(delivery.WebhookID), delivery.Id, data).Result()
+	if err != nil {
+		return fmt.Errorf("failed to save webhook delivery in Redis: %v", err)
+	}
+	if !isNew {
+		return nil
+	}
+
+	orderKey := webhookDeliveryOrderKey(delivery.WebhookID)
+	length, err := redisClient.RPush(orderKey, delivery.Id).Result()
+	if err != nil {
+		return fmt.Errorf("failed to save webhook delivery in Redis: %v", err)
+	}
+	for ; length > webhookDeliveryLimit; length-- {
+		oldest, err := redisClient.LPop(orderKey).Result()
+		if err != nil {
+			return fmt.Errorf("failed to trim webhook deliveries in Redis: %v", err)
+		}
+		redisClient.HDel(webhookDeliveriesKey(delivery.WebhookID), oldest)
+	}
+	return nil
+}
+
+func getWebhookDelivery(webhookID string, deliveryID string) (*WebhookDelivery, error) {
+	data, err := redisClient.HGet(webhookDeliveriesKey(webhookID), deliveryID).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("delivery not found")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get webhook delivery from Redis: %v", err)
+	}
+
+	var delivery WebhookDelivery
+	if err := json.Unmarshal([]byte(data), &delivery); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal webhook delivery: %v", err)
+	}
+	return &delivery, nil
+}
+
+// getWebhookDeliveries returns the logged deliveries of a webhook, newest first
+func getWebhookDeliveries(webhookID string) ([]WebhookDelivery, error) {
+	ids, err := redisClient.LRange(webhookDeliveryOrderKey(webhookID), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook deliveries from Redis: %v", err)
+	}
+	deliveries := make([]WebhookDelivery, 0, len(ids))
+	if len(ids) == 0 {
+		return deliveries, nil
+	}
+
+	entries, err := redisClient.HMGet(webhookDeliveriesKey(webhookID), ids...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook deliveries from Redis: %v", err)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry, ok := entries[i].(string)
+		if !ok {
+			continue
+		}
+		var delivery WebhookDelivery
+		if err := json.Unmarshal([]byte(entry), &delivery); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal webhook delivery: %v", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// recordWebhookFailure counts a failed delivery and returns the number of failures in a row
+func recordWebhookFailure(webhookID string) (int64, error) {
+	failures, err := redisClient.Incr(webhookFailuresKey(webhookID)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count webhook failure in Redis: %v", err)
+	}
+	return failures, nil
+}
+
+func resetWebhookFailures(webhookID string) error {
+	if err := redisClient.Del(webhookFailuresKey(webhookID)).Err(); err != nil {
+		return fmt.Errorf("failed to reset webhook failures in Redis: %v", err)
+	}
+	return nil
+}
+
+// webhookScheduleKey orders pending webhook deliveries by the unix millisecond time of their next attempt
+const webhookScheduleKey = "webhooks:schedule"
+
+func scheduledDeliveryMember(webhookID string, deliveryID string) string {
+	return webhookID + ":" + deliveryID
+}
+
+// scheduleWebhookDelivery stores when the next attempt of a pending delivery is due
+func scheduleWebhookDelivery(webhookID string, deliveryID string, at time.Time) error {
+	member := redis.Z{Score: float64(at.UnixMilli()), Member: scheduledDeliveryMember(webhookID, deliveryID)}
+	if err := redisClient.ZAdd(webhookScheduleKey, member).Err(); err != nil {
+		return fmt.Errorf("failed to schedule webhook delivery in Redis: %v", err)
+	}
+	return nil
+}
+
+func unscheduleWebhookDelivery(webhookID string, deliveryID string) error {
+	if err := redisClient.ZRem(webhookScheduleKey, scheduledDeliveryMember(webhookID, deliveryID)).Err(); err != nil {
+		return fmt.Errorf("failed to unschedule webhook delivery in Redis: %v", err)
+	}
+	return nil
+}
+
+// claimWebhookDeliveryScript pushes a due delivery back by the lease, so one process makes each attempt
+var claimWebhookDeliveryScript = redis.NewScript(`
+local due = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if due and tonumber(due) <= tonumber(ARGV[2]) then
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+	return 1
+end
+return 0`)
+
+// claimWebhookDelivery reports whether this process may attempt a due delivery, which is retried
+// by any process after the lease if this one stops before rescheduling or finishing it
+func claimWebhookDelivery(webhookID string, deliveryID string, now time.Time, lease time.Duration) (bool, error) {
+	claimed, err := claimWebhookDeliveryScript.Run(redisClient, []string{webhookScheduleKey},
+		scheduledDeliveryMember(webhookID, deliveryID), now.UnixMilli(), now.Add(lease).UnixMilli()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim webhook delivery in Redis: %v", err)
+	}
+	return claimed == 1, nil
+}
+
+// getDueWebhookDeliveries returns the webhook and delivery IDs of the deliveries due by now
+func getDueWebhookDeliveries(now time.Time) ([][2]string, error) {
+	members, err := redisClient.ZRangeByScore(webhookScheduleKey, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scheduled webhook deliveries from Redis: %v", err)
+	}
+	due := make([][2]string, 0, len(members))
+	for _, member := range members {
+		if webhookID, deliveryID, ok := strings.Cut(member, ":"); ok {
+			due = append(due, [2]string{webhookID, deliveryID})
+		}
+	}
+	return due, nil
+}
+
+func idempotencyKey(scope string) string {
+	return "idempotency:" + scope
+}
+
+// reserveIdempotencyKey stores the record unless the key was already used, reporting whether it did
+func reserveIdempotencyKey(scope string, record *IdempotencyRecord, ttl time.Duration) (bool, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal idempotency record: %v", err)
+	}
+	reserved, err := redisClient.SetNX(idempotencyKey(scope), data, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to reserve idempotency key in Redis: %v", err)
+	}
+	return reserved, nil
+}
+
+func getIdempotencyRecord(scope string) (*IdempotencyRecord, error) {
+	data, err := redisClient.Get(idempotencyKey(scope)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idempotency record from Redis: %v", err)
+	}
+	var record IdempotencyRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal idempotency record: %v", err)
+	}
+	return &record, nil
+}
+
+func setIdempotencyRecord(scope string, record *IdempotencyRecord, ttl time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal idempotency record: %v", err)
+	}
+	if err := redisClient.Set(idempotencyKey(scope), data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to set idempotency record in Redis: %v", err)
+	}
+	return nil
+}
+
+func releaseIdempotencyKey(scope string) error {
+	if err := redisClient.Del(idempotencyKey(scope)).Err(); err != nil {
+		return fmt.Errorf("failed to release idempotency key in Redis: %v", err)
+	}
 	return nil
 }
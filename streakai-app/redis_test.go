@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIncrementRateCounterAlwaysExpires(t *testing.T) {
+	for want := int64(1); want <= 2; want++ {
+		count, err := incrementRateCounter("test", "session", "alice", time.Minute)
+		if err != nil || count != want {
+			t.Fatalf("count %d, %v, want %d", count, err, want)
+		}
+	}
+	key := "ratelimit:test:session:alice"
+	if ttl := redisClient.PTTL(key).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("counter expires in %v", ttl)
+	}
+
+	// a counter left without an expiry, e.g. when a client stopped between INCR and EXPIRE, expires again
+	redisClient.Set("ratelimit:test:session:bob", 7, 0)
+	if count, err := incrementRateCounter("test", "session", "bob", time.Minute); err != nil || count != 8 {
+		t.Fatalf("count %d, %v", count, err)
+	}
+	if ttl := redisClient.PTTL("ratelimit:test:session:bob").Val(); ttl <= 0 {
+		t.Errorf("stuck counter expires in %v", ttl)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+)
+
+// eventReplayLimit is how many recent events of a session are kept for resuming clients
+const eventReplayLimit = 256
+
+// replayEvents returns the buffered events of a session after the given sequence number.
+// It returns false when the buffer no longer reaches back that far and a snapshot is needed instead.
+func replayEvents(sessionID string, after int64) ([]json.RawMessage, bool, error) {
+	entries, err := getEventLog(sessionID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	type buffered struct {
+		seq  int64
+		data json.RawMessage
+	}
+	events := make([]buffered, 0, len(entries))
+	for _, entry := range entries {
+		var event Event
+		if err := json.Unmarshal([]byte(entry), &event); err != nil {
+			return nil, false, err
+		}
+		events = append(events, buffered{event.Seq, json.RawMessage(entry)})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].seq < events[j].seq })
+
+	current, err := currentEventSeq(sessionID)
+	if err != nil {
+		return nil, false, err
+	}
+	if after >= current {
+		return nil, true, nil
+	}
+	if len(events) == 0 || events[0].seq > after+1 {
+		return nil, false, nil
+	}
+
+	var missed []json.RawMessage
+	for _, event := range events {
+		if event.seq > after {
+			missed = append(missed, event.data)
+		}
+	}
+	return missed, true, nil
+}
+
+// resume brings a subscribing client up to date, replaying the events it missed
+// since msg.ResumeFrom when they are still buffered and sending a snapshot otherwise
+func (c *Client) resume(h *Hub, msg ClientMessage) {
+	if msg.ResumeFrom == nil || msg.SessionID == "" || msg.Workspace != "" {
+		c.sendSnapshot(h, msg)
+		return
+	}
+
+	missed, ok, err := replayEvents(msg.SessionID, *msg.ResumeFrom)
+	if err != nil {
+		log.Printf("Error replaying events: %v", err)
+		ok = false
+	}
+	// a replay the send queue cannot hold would disconnect the client as a slow consumer
+	if len(missed) > sendBufferSize-len(c.send) {
+		ok = false
+	}
+	if !ok {
+		log.Printf("Gap after seq %d of session %s too large, sending snapshot", *msg.ResumeFrom, msg.SessionID)
+		c.sendSnapshot(h, msg)
+		return
+	}
+
+	for _, data := range missed {
+		h.sendTo(c, data)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+// resumeTestClient resumes a new client of a private hub after seq and returns the events it was sent
+func resumeTestClient(t *testing.T, sessionID string, after int64) []*rawEvent {
+	t.Helper()
+	h := newHub()
+	client := newClient(nil, "carol", "")
+	h.register(client)
+	defer h.unregister(client)
+	client.resume(h, ClientMessage{SessionID: sessionID, ResumeFrom: &after})
+
+	var events []*rawEvent
+	for _, data := range queued(client) {
+		event, err := decodeEvent(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestResumeReplaysMissedEvents(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"resumed"}`)
+	from, _ := currentEventSeq(id)
+	castTestVote(t, "bob", id)
+	castTestVote(t, "dave", id)
+	current, _ := currentEventSeq(id)
+
+	events := resumeTestClient(t, id, from)
+	if int64(len(events)) != current-from {
+		t.Fatalf("replayed %d events after seq %d, want %d", len(events), from, current-from)
+	}
+	for i, event := range events {
+		if event.Seq != from+int64(i)+1 || event.Type == eventSessionSnapshot {
+			t.Errorf("replayed event %d is %s seq %d", i, event.Type, event.Seq)
+		}
+	}
+	if events := resumeTestClient(t, id, current); len(events) != 0 {
+		t.Errorf("an up to date client was sent %d events", len(events))
+	}
+}
+
+func TestResumeSendsSnapshotAfterLargeGap(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"gap"}`)
+	session, err := getSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, _ := currentEventSeq(id)
+	for i := 0; i <= eventReplayLimit; i++ {
+		broadcastSessionStatus(eventSessionUpdated, session)
+	}
+	current, _ := currentEventSeq(id)
+
+	events := resumeTestClient(t, id, from)
+	if len(events) != 1 || events[0].Type != eventSessionSnapshot || events[0].Seq != current {
+		t.Fatalf("resuming past the buffer sent %d events, first %+v", len(events), events[0].Event)
+	}
+	if events := resumeTestClient(t, id, current-sendBufferSize); len(events) != sendBufferSize || events[0].Type != eventSessionUpdated {
+		t.Errorf("resuming %d events back replayed %d events", sendBufferSize, len(events))
+	}
+	// a replay longer than the send queue would drop the client as a slow consumer
+	if events := resumeTestClient(t, id, current-sendBufferSize-1); len(events) != 1 || events[0].Type != eventSessionSnapshot {
+		t.Errorf("resuming %d events back sent %d events", sendBufferSize+1, len(events))
+	}
+}
@@ -2,96 +2,248 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/mux"
 )
 
-// castVote handles the voting process for a session
-func castVote(w http.ResponseWriter, r *http.Request) {
-	log.Println("Handling cast vote request")
-	defer r.Body.Close()
+// voteRetries is how often a vote is cast again when other replicas keep appending ballots to the session
+const voteRetries = 5
 
-	var singleVote SingleVote
-	if err := json.NewDecoder(r.Body).Decode(&singleVote); err != nil {
-		log.Printf("Error decoding JSON: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// errBallotConflict reports a session, or its ballot chain, that changed since a vote was cast on it
+var errBallotConflict = errors.New("ballot chain changed")
+
+// recordVote casts or changes the user's vote in a session and broadcasts the new state
+func recordVote(username string, singleVote SingleVote) (*Ballot, error) {
+	ballotMutex.Lock()
+	defer ballotMutex.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		session, err := getSession(singleVote.Id)
+		if err != nil {
+			return nil, &statusError{status: http.StatusNotFound, message: "Session not found"}
+		}
+		if session.Closed {
+			return nil, &statusError{status: http.StatusConflict, message: "Session is closed"}
+		}
+
+		votersBefore := voterCount(session)
+		var ballot *Ballot
+		switch session.Mode {
+		case modeQuadratic:
+			ballot, err = castQuadraticVote(session, username, singleVote.Allocation)
+		case modeDots:
+			ballot, err = castDotVote(session, username, singleVote.Allocation)
+		default:
+			ballot, err = castBinaryVote(session, username, singleVote.Vote, singleVote.Change)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// another replica recorded a ballot or edited the session meanwhile, the vote is cast again on the updated session
+		err = commitBallot(session, ballot, username)
+		if err == errBallotConflict && attempt < voteRetries {
+			continue
+		} else if err == errBallotConflict {
+			return nil, &statusError{status: http.StatusConflict, message: "The session is receiving too many votes at once, please retry"}
+		} else if err != nil {
+			return nil, err
+		}
+		broadcastSessionStatus(eventVoteCast, session)
+		if session.Quorum > 0 && votersBefore < session.Quorum && voterCount(session) >= session.Quorum {
+			broadcastSessionStatus(eventSessionQuorum, session)
+		}
+		return ballot, nil
+	}
+}
+
+// castBinaryVote records a yes/no vote for the user, or replaces their earlier one when changing it
+func castBinaryVote(session *VotingSession, username string, vote bool, change bool) (*Ballot, error) {
+	voted := alreadyVoted(session.YesCount, session.NoCount, username)
+	if voted && !change {
+		return nil, &statusError{status: http.StatusConflict, message: "User has already voted"}
+	}
+	if !voted && change {
+		return nil, &statusError{status: http.StatusConflict, message: "User has not voted yet"}
+	}
+
+	ballot, err := nextBallot(session, username, vote, nil)
+	if err != nil {
+		return nil, err
+	}
+	session.YesCount = removeUser(session.YesCount, username)
+	session.NoCount = removeUser(session.NoCount, username)
+	if vote {
+		session.YesCount = append(session.YesCount, username)
+	} else {
+		session.NoCount = append(session.NoCount, username)
 	}
-	log.Printf("Decoded vote: %+v", singleVote)
-
-	username, _ := isAuthorised(w, r)
-	for i, session := range sessions {
-		log.Printf("%d: %+v", i, session)
-		if session.Id == singleVote.Id {
-			if !alreadyVoted(session.YesCount, session.NoCount, username) {
-				if singleVote.Vote {
-					session.YesCount = append(session.YesCount, username)
-				} else {
-					session.NoCount = append(session.NoCount, username)
-				}
-				setSession(session)
-				broadcastSessionStatus(session)
-				SendResponse(w, http.StatusOK, map[string]string{"message": "vote cast"})
-				return
-			} else {
-				http.Error(w, "User has already voted", http.StatusConflict)
-				return
-			}
+	return ballot, nil
+}
+
+// removeUser returns the voters without the given user
+func removeUser(voters []string, username string) []string {
+	for i, u := range voters {
+		if u == username {
+			return append(voters[:i], voters[i+1:]...)
 		}
 	}
-	http.Error(w, "Session not found", http.StatusNotFound)
+	return voters
 }
 
-// getSessionHandler handles fetching a session by ID
-func getSessionHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	sessionID, ok := vars["id"]
-	if !ok {
-		http.Error(w, "Missing session ID", http.StatusBadRequest)
-		return
+// createSession validates and stores a new session owned by the user, then broadcasts it
+func createSession(owner string, votingSession *VotingSession) error {
+	if err := prepareSession(owner, votingSession); err != nil {
+		return err
 	}
+	if err := insertSession(votingSession); err != nil {
+		return err
+	}
+	broadcastSessionStatus(eventSessionCreated, votingSession)
+	logAllSessions()
+	return nil
+}
 
-	session, err := getSession(sessionID)
+// prepareSession validates a new session and resets everything but its voting rules
+func prepareSession(owner string, votingSession *VotingSession) error {
+	if err := validateSession(votingSession); err != nil {
+		return &statusError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	votingSession.Id = uuid.New().String()
+	votingSession.Owner = owner
+	votingSession.YesCount = nil
+	votingSession.NoCount = nil
+	votingSession.BallotHead = ""
+	votingSession.Closed = false
+	votingSession.ClosedAt = 0
+	votingSession.Result = nil
+	votingSession.Allocations = nil
+	votingSession.Version = 0
+	votingSession.Archived = false
+	return nil
+}
+
+// closeSession closes a session owned by the user and freezes its tally together with the weights it used.
+// It fails with 412 unless the session is still at expectedVersion, which may be anyVersion.
+func closeSession(username string, sessionID string, expectedVersion int64) (*Tally, error) {
+	ballotMutex.Lock()
+	defer ballotMutex.Unlock()
+
+	session, err := loadEditableSession(username, sessionID, expectedVersion, "Only the session owner can close it")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
+		return nil, err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(session); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	tally, err := computeTally(session)
+	if err != nil {
+		return nil, err
+	}
+	session.Closed = true
+	session.ClosedAt = time.Now().Unix()
+	session.Result = &tally
+
+	if err := setSessionIfVersion(session, session.Version); err != nil {
+		return nil, err
+	}
+	broadcastSessionStatus(eventSessionClosed, session)
+	return &tally, nil
+}
+
+// updateSession replaces the name, weights and quorum of an open session owned by the user,
+// provided it is still at expectedVersion so concurrent edits are not silently overwritten
+func updateSession(username string, sessionID string, expectedVersion int64, edit *VotingSession) (*VotingSession, error) {
+	if edit.Name == "" {
+		return nil, &statusError{status: http.StatusBadRequest, message: "A session name is required"}
+	}
+
+	ballotMutex.Lock()
+	defer ballotMutex.Unlock()
+
+	session, err := loadEditableSession(username, sessionID, expectedVersion, "Only the session owner can edit it")
+	if err != nil {
+		return nil, err
+	}
+	reachedBefore := session.Quorum > 0 && voterCount(session) >= session.Quorum
+	session.Name = edit.Name
+	session.Weights = edit.Weights
+	session.Quorum = edit.Quorum
+	if err := validateSession(session); err != nil {
+		return nil, &statusError{status: http.StatusBadRequest, message: err.Error()}
+	}
+
+	if err := setSessionIfVersion(session, session.Version); err != nil {
+		return nil, err
+	}
+	broadcastSessionStatus(eventSessionUpdated, session)
+	if !reachedBefore && session.Quorum > 0 && voterCount(session) >= session.Quorum {
+		broadcastSessionStatus(eventSessionQuorum, session)
+	}
+	return session, nil
+}
+
+// loadEditableSession returns an open session owned by the user at expectedVersion
+func loadEditableSession(username string, sessionID string, expectedVersion int64, forbidden string) (*VotingSession, error) {
+	session, err := getSession(sessionID)
+	if err != nil {
+		return nil, &statusError{status: http.StatusNotFound, message: err.Error()}
 	}
+	if session.Owner != username {
+		return nil, &statusError{status: http.StatusForbidden, message: forbidden}
+	}
+	if expectedVersion != anyVersion && session.Version != expectedVersion {
+		return nil, errVersionConflict
+	}
+	if session.Closed {
+		return nil, &statusError{status: http.StatusConflict, message: "Session is already closed"}
+	}
+	return session, nil
 }
 
-// createSessionHandler handles the creation of a new voting session
-func createSessionHandler(w http.ResponseWriter, r *http.Request) {
-	_, isAuthorised := isAuthorised(w, r)
-	if isAuthorised {
-		log.Println("Handling create voting session request")
-		defer r.Body.Close()
-
-		var votingSession VotingSession
-		if err := json.NewDecoder(r.Body).Decode(&votingSession); err != nil {
-			log.Printf("Error decoding JSON: %v", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+// validateSession checks the voting rules a client supplied when creating a session
+func validateSession(session *VotingSession) error {
+	for user, weight := range session.Weights {
+		if weight < 0 {
+			return fmt.Errorf("invalid weight for %s", user)
 		}
-		log.Printf("Decoded Job: %+v", votingSession)
-		votingSession.Id = uuid.New().String()
+	}
+	if session.Quorum < 0 {
+		return fmt.Errorf("quorum cannot be negative")
+	}
 
-		setSession(&votingSession)
-		broadcastSessionStatus(&votingSession)
-		logAllSessions()
-		SendResponse(w, http.StatusOK, map[string]string{"message": "Session created", "sessionID": votingSession.Id})
-	} else {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	switch session.Mode {
+	case modeBinary:
+		return nil
+	case modeQuadratic:
+		if session.Credits <= 0 {
+			return fmt.Errorf("quadratic sessions need a positive credit budget")
+		}
+		return validateOptions(session.Options)
+	case modeDots:
+		if session.Dots <= 0 {
+			return fmt.Errorf("dot-voting sessions need a positive number of dots")
+		}
+		return validateOptions(session.Options)
+	default:
+		return fmt.Errorf("unknown mode %s", session.Mode)
 	}
 }
 
+// statusError is an error that carries the HTTP status it should be reported with
+type statusError struct {
+	status  int
+	message string
+	details interface{}
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
 // SendResponse sends a JSON response with a given status code and payload
 func SendResponse(w http.ResponseWriter, statusCode int, payload interface{}) {
 	response, err := json.Marshal(payload)
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// handleSessionEvents streams a session's events as Server-Sent Events for clients
+// behind proxies that break websockets, resuming after the Last-Event-ID when given
+func handleSessionEvents(w http.ResponseWriter, r *http.Request) {
+	username, isAuthorised := isAuthorised(w, r)
+	if !isAuthorised {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sessionID := mux.Vars(r)["id"]
+	session, err := getSession(sessionID)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	client := newClient(nil, username, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	hub.register(client)
+	defer hub.unregister(client)
+	hub.subscribe(client, ClientMessage{SessionID: sessionID})
+
+	// the stream ends like a websocket once the token expires or is revoked
+	stopped := make(chan string, 1)
+	go monitorToken(client.token, username, client.done, func(reason string) { stopped <- reason })
+
+	if err := sendInitialEvents(w, session, r.Header.Get("Last-Event-ID")); err != nil {
+		log.Printf("Error sending initial events: %v", err)
+		return
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(pingPeriod)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case reason := <-stopped:
+			data, _ := json.Marshal(map[string]string{"reason": reason})
+			fmt.Fprintf(w, "event: closed\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		case data, ok := <-client.send:
+			if !ok {
+				return
+			}
+			if err := writeSSE(w, data); err != nil {
+				log.Printf("Error writing event to SSE client: %v", err)
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// sendInitialEvents replays the events after lastEventID or, without one or when the gap is too large, a snapshot
+func sendInitialEvents(w http.ResponseWriter, session *VotingSession, lastEventID string) error {
+	var after *int64
+	if lastEventID != "" {
+		if seq, err := strconv.ParseInt(lastEventID, 10, 64); err == nil {
+			after = &seq
+		}
+	}
+
+	events, err := initialEvents(session, after)
+	if err != nil {
+		return err
+	}
+	for _, data := range events {
+		if err := writeSSE(w, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initialEvents returns the buffered events after the given seq or, without one or when the gap is too large, a snapshot
+func initialEvents(session *VotingSession, after *int64) ([]json.RawMessage, error) {
+	if after != nil {
+		missed, ok, err := replayEvents(session.Id, *after)
+		if err != nil {
+			log.Printf("Error replaying events: %v", err)
+		} else if ok {
+			return missed, nil
+		}
+	}
+
+	event, err := newSessionEvent(eventSessionSnapshot, session)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return []json.RawMessage{data}, nil
+}
+
+// writeSSE frames an encoded event with its seq as the id and its type as the event name. Events that are not
+// buffered for replay have seq 0 and no id, so the client keeps resuming after the last event it can be replayed.
+func writeSSE(w io.Writer, data []byte) error {
+	var header struct {
+		Type string `json:"type"`
+		Seq  int64  `json:"seq"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+	if header.Seq != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", header.Seq); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", header.Type, data)
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseFrame is one event read from a Server-Sent Events stream
+type sseFrame struct {
+	id    string
+	event string
+	data  string
+}
+
+// openEventStream streams a session's events as the user, resuming after lastEventID when it is set.
+// The frames channel is closed when the stream ends.
+func openEventStream(t *testing.T, user string, sessionID string, lastEventID string) <-chan sseFrame {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, testServerURL+"/v1/sessions/"+sessionID+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer token-"+user)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("event stream answered %d", resp.StatusCode)
+	}
+
+	frames := make(chan sseFrame, 16)
+	go func() {
+		defer close(frames)
+		scanner := bufio.NewScanner(resp.Body)
+		var frame sseFrame
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if frame.event != "" {
+					frames <- frame
+				}
+				frame = sseFrame{}
+			case strings.HasPrefix(line, "id: "):
+				frame.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				frame.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				frame.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return frames
+}
+
+// nextFrame returns the next frame of the stream, skipping presence changes, failing the test when none arrives in time
+func nextFrame(t *testing.T, frames <-chan sseFrame) sseFrame {
+	t.Helper()
+	for timeout := time.After(5 * time.Second); ; {
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				t.Fatalf("the event stream ended")
+			}
+			if frame.event != eventPresenceChanged {
+				return frame
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for an event")
+		}
+	}
+}
+
+func TestEventStreamResumesAfterLastEventID(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"sse resume"}`)
+	frames := openEventStream(t, "alice", id, "")
+	if frame := nextFrame(t, frames); frame.event != eventSessionSnapshot {
+		t.Fatalf("the stream started with %+v", frame)
+	}
+
+	castTestVote(t, "bob", id)
+	first := nextFrame(t, frames)
+	castTestVote(t, "carol", id)
+	second := nextFrame(t, frames)
+	if first.event != eventVoteCast || second.event != eventVoteCast || first.id == second.id {
+		t.Fatalf("votes streamed as %+v and %+v", first, second)
+	}
+
+	// a client that saw the first vote gets the second one replayed instead of a snapshot
+	resumed := nextFrame(t, openEventStream(t, "alice", id, first.id))
+	if resumed.id != second.id || resumed.data != second.data {
+		t.Errorf("resumed with %+v, want %+v", resumed, second)
+	}
+	if frame := nextFrame(t, openEventStream(t, "alice", id, "not a seq")); frame.event != eventSessionSnapshot {
+		t.Errorf("an unusable Last-Event-ID resumed with %+v", frame)
+	}
+}
+
+func TestEventStreamEndsWhenTokenIsRevoked(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"sse revoke"}`)
+	frames := openEventStream(t, "erin", id, "")
+	nextFrame(t, frames)
+	revokeTestToken(t, "erin")
+
+	if frame := nextFrame(t, frames); frame.event != "closed" || !strings.Contains(frame.data, "token revoked") {
+		t.Errorf("the stream ended with %+v", frame)
+	}
+	for timeout := time.After(5 * time.Second); ; {
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+			if frame.event != eventPresenceChanged {
+				t.Errorf("the stream went on with %+v", frame)
+			}
+		case <-timeout:
+			t.Fatalf("the stream was not closed")
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+// voterWeight returns the weight of a user in a session, defaulting to 1
+func voterWeight(session *VotingSession, username string) float64 {
+	if weight, ok := session.Weights[username]; ok {
+		return weight
+	}
+	return 1
+}
+
+// computeTally sums the weight of direct votes and of the votes delegated to each direct voter.
+// Option based sessions sum the weighted votes per option instead.
+func computeTally(session *VotingSession) (Tally, error) {
+	tally := Tally{
+		Delegations: make(map[string]float64),
+		Weights:     make(map[string]float64),
+	}
+
+	if isOptionMode(session.Mode) {
+		for user := range session.Allocations {
+			tally.Weights[user] = voterWeight(session, user)
+		}
+		tally.Options = allocationTotals(session.Allocations, session)
+		return tally, nil
+	}
+
+	direct := make(map[string]bool)
+	choice := make(map[string]bool)
+	for _, u := range session.YesCount {
+		direct[u] = true
+		choice[u] = true
+		tally.Weights[u] = voterWeight(session, u)
+		tally.DirectYes += tally.Weights[u]
+	}
+	for _, u := range session.NoCount {
+		direct[u] = true
+		tally.Weights[u] = voterWeight(session, u)
+		tally.DirectNo += tally.Weights[u]
+	}
+
+	delegations, err := effectiveDelegations(session)
+	if err != nil {
+		return tally, err
+	}
+
+	for from := range delegations {
+		// a direct vote by the delegator overrides their delegation
+		if direct[from] {
+			continue
+		}
+		delegate, ok := resolveDelegate(from, delegations, direct)
+		if !ok {
+			continue
+		}
+		weight := voterWeight(session, from)
+		tally.Weights[from] = weight
+		tally.Delegations[delegate] += weight
+		if choice[delegate] {
+			tally.DelegatedYes += weight
+		} else {
+			tally.DelegatedNo += weight
+		}
+	}
+
+	tally.Yes = tally.DirectYes + tally.DelegatedYes
+	tally.No = tally.DirectNo + tally.DelegatedNo
+	return tally, nil
+}
+
+// sessionView attaches the tally to a session for responses and broadcasts.
+// Closed sessions report the result recorded at close time.
+func sessionView(session *VotingSession) (*SessionView, error) {
+	view := &SessionView{VotingSession: session}
+	if session.Result != nil {
+		view.Tally = *session.Result
+	} else {
+		tally, err := computeTally(session)
+		if err != nil {
+			return nil, err
+		}
+		view.Tally = tally
+	}
+
+	if session.Mode == modeQuadratic {
+		view.RemainingCredits = remainingCredits(session)
+	}
+	if isOptionMode(session.Mode) {
+		view.Ranking = rankOptions(session, view.Tally.Options)
+	}
+
+	presence, err := sessionPresence(session)
+	if err != nil {
+		return nil, err
+	}
+	view.Presence = presence
+	return view, nil
+}
+
+// voterCount returns how many users voted directly in the session
+func voterCount(session *VotingSession) int {
+	if isOptionMode(session.Mode) {
+		return len(session.Allocations)
+	}
+	return len(session.YesCount) + len(session.NoCount)
+}
+
+// sessionVoters returns the users who cast a vote in the session, whatever its mode
+func sessionVoters(session *VotingSession) []string {
+	if isOptionMode(session.Mode) {
+		return sortedKeys(session.Allocations)
+	}
+	return append(append([]string{}, session.YesCount...), session.NoCount...)
+}
+
+// isOptionMode reports whether votes in the mode are allocations across options
+func isOptionMode(mode string) bool {
+	return mode == modeQuadratic || mode == modeDots
+}
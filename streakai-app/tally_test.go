@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// closeTestSession closes a session of alice at its current version
+func closeTestSession(t *testing.T, id string) {
+	t.Helper()
+	resp, data := apiRequest(t, http.MethodGet, "/v1/sessions/"+id, "alice", nil, "")
+	expectStatus(t, resp, data, http.StatusOK)
+	resp, data = apiRequest(t, http.MethodPost, "/v1/sessions/"+id+"/close", "alice", map[string]string{"If-Match": resp.Header.Get("ETag")}, "")
+	expectStatus(t, resp, data, http.StatusOK)
+}
+
+func TestTallyAppliesWeights(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"weighted","weights":{"bob":3,"carol":0.5}}`)
+	castTestVote(t, "bob", id)
+	castTestVote(t, "dave", id)
+	resp, data := apiRequest(t, http.MethodPatch, "/v1/sessions", "carol", nil, `{"id":"`+id+`","vote":false}`)
+	expectStatus(t, resp, data, http.StatusOK)
+
+	tally := getTestTally(t, id)
+	if tally.Yes != 4 || tally.No != 0.5 {
+		t.Errorf("weighted tally yes %v, no %v", tally.Yes, tally.No)
+	}
+	if want := map[string]float64{"bob": 3, "carol": 0.5, "dave": 1}; !reflect.DeepEqual(tally.Weights, want) {
+		t.Errorf("weights %v, want %v", tally.Weights, want)
+	}
+}
+
+func TestCloseRecordsWeights(t *testing.T) {
+	id := createTestSession(t, "alice", `{"name":"recorded","weights":{"bob":2}}`)
+	castTestVote(t, "bob", id)
+	closeTestSession(t, id)
+
+	session, err := getSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Result == nil || session.Result.Yes != 2 || session.Result.Weights["bob"] != 2 {
+		t.Fatalf("result %+v", session.Result)
+	}
+
+	// the result keeps the weights of close time even when the table changes afterwards
+	session.Weights = map[string]float64{"bob": 10}
+	sessionData, _ := json.Marshal(session)
+	if err := redisClient.Set(id, sessionData, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if tally := getTestTally(t, id); tally.Yes != 2 || tally.Weights["bob"] != 2 {
+		t.Errorf("closed tally %+v", tally)
+	}
+}
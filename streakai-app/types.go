@@ -1,46 +1,317 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	pb "streakai/grpc"
 	"sync"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/gorilla/websocket"
 )
 
-type User struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-}
-
-type UserLogoutReq struct {
-	Username string `json:"username"`
-}
-
 type VotingSession struct {
 	Name     string   `json:"name"`
 	Id       string   `json:"id"`
 	YesCount []string `json:"yesCount"`
 	NoCount  []string `json:"noCount"`
+	// BallotHead is the hash of the latest ballot in the session's ballot log
+	BallotHead string `json:"ballotHead,omitempty"`
+	// Workspace groups sessions so delegations can apply to all of them
+	Workspace string `json:"workspace,omitempty"`
+	Owner     string `json:"owner,omitempty"`
+	// Weights maps usernames to their vote weight, users not listed weigh 1
+	Weights  map[string]float64 `json:"weights,omitempty"`
+	Closed   bool               `json:"closed"`
+	ClosedAt int64              `json:"closedAt,omitempty"`
+	// Result is the tally frozen when the session was closed
+	Result *Tally `json:"result,omitempty"`
+	// Mode selects how votes are cast, a yes/no vote unless set
+	Mode    string   `json:"mode,omitempty"`
+	Options []string `json:"options,omitempty"`
+	// Credits is the budget each voter spends in a quadratic session
+	Credits int `json:"credits,omitempty"`
+	// Allocations maps usernames to the votes they placed on each option
+	Allocations map[string]map[string]int `json:"allocations,omitempty"`
+	// Dots is the number of dots each participant distributes in a dot-voting session
+	Dots int `json:"dots,omitempty"`
+	// Quorum is the number of voters at which the session announces it reached quorum, 0 for none
+	Quorum int `json:"quorum,omitempty"`
+	// Version increases with every write of the session, it is sent as its ETag
+	Version int64 `json:"version"`
+	// Archived sessions are closed and left out of the session lists, they stay readable by ID
+	Archived bool `json:"archived,omitempty"`
 }
 
 type SingleVote struct {
 	Id   string `json:"id"`
 	Vote bool   `json:"vote"`
+	// Allocation is the number of votes per option, used instead of Vote by option based modes
+	Allocation map[string]int `json:"allocation,omitempty"`
+	// Change replaces an earlier yes/no vote instead of rejecting the second one
+	Change bool `json:"change,omitempty"`
 }
 type AllSessions []*VotingSession
 
+// Ballot is one entry of a session's append-only, hash-chained ballot log
+type Ballot struct {
+	Seq       int    `json:"seq"`
+	PrevHash  string `json:"prevHash"`
+	Voter     string `json:"voter"`
+	Vote      bool   `json:"vote"`
+	Timestamp int64  `json:"timestamp"`
+	Hash      string `json:"hash"`
+	// Allocation is set instead of Vote for option based modes
+	Allocation map[string]int `json:"allocation,omitempty"`
+}
+
+// VoteReceipt is handed to the voter so they can find their ballot in the published chain
+type VoteReceipt struct {
+	SessionID string `json:"sessionId"`
+	Seq       int    `json:"seq"`
+	Voter     string `json:"voter"`
+	Hash      string `json:"hash"`
+}
+
+// Tally is the weighted result of a session, split into direct and delegated weight
+type Tally struct {
+	Yes          float64 `json:"yes"`
+	No           float64 `json:"no"`
+	DirectYes    float64 `json:"directYes,omitempty"`
+	DirectNo     float64 `json:"directNo,omitempty"`
+	DelegatedYes float64 `json:"delegatedYes,omitempty"`
+	DelegatedNo  float64 `json:"delegatedNo,omitempty"`
+	// Delegations maps each direct voter to the weight delegated to them
+	Delegations map[string]float64 `json:"delegations,omitempty"`
+	// Weights records the weight applied to every user counted in the tally
+	Weights map[string]float64 `json:"weights,omitempty"`
+	// Options holds the weighted votes per option of option based modes
+	Options map[string]float64 `json:"options,omitempty"`
+}
+
+// SessionView is a session as sent to clients, with its computed tally
+type SessionView struct {
+	*VotingSession
+	Tally Tally `json:"tally"`
+	// RemainingCredits maps each voter of a quadratic session to their unspent credits
+	RemainingCredits map[string]int `json:"remainingCredits,omitempty"`
+	// Ranking lists the options of option based modes from most to least supported
+	Ranking []RankedOption `json:"ranking,omitempty"`
+	// Presence lists the users currently connected to the session
+	Presence *Presence `json:"presence,omitempty"`
+}
+
+type RankedOption struct {
+	Rank   int     `json:"rank"`
+	Option string  `json:"option"`
+	Total  float64 `json:"total"`
+}
+
+// ClientMessage is sent by websocket clients to manage subscriptions or run a command
+type ClientMessage struct {
+	Action    string `json:"action"`
+	SessionID string `json:"sessionId,omitempty"`
+	Workspace string `json:"workspace,omitempty"`
+	// Token authenticates connections that could not send it during the handshake
+	Token string `json:"token,omitempty"`
+	// ResumeFrom is the last seq the client saw, events after it are replayed on subscribe
+	ResumeFrom *int64 `json:"resumeFrom,omitempty"`
+	// RequestID is echoed in the acknowledgement or error answering a command
+	RequestID  string         `json:"requestId,omitempty"`
+	Vote       bool           `json:"vote,omitempty"`
+	Allocation map[string]int `json:"allocation,omitempty"`
+	Session    *VotingSession `json:"session,omitempty"`
+	Emoji      string         `json:"emoji,omitempty"`
+	Text       string         `json:"text,omitempty"`
+	MessageID  string         `json:"messageId,omitempty"`
+	User       string         `json:"user,omitempty"`
+}
+
+// ChatMessage is a message of a session's chat thread
+type ChatMessage struct {
+	Id        string    `json:"id"`
+	User      string    `json:"user"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Event is the versioned envelope of every update pushed to real-time clients
+type Event struct {
+	Version   int         `json:"v"`
+	Type      string      `json:"type"`
+	SessionID string      `json:"sessionId"`
+	Seq       int64       `json:"seq"`
+	Timestamp time.Time   `json:"timestamp"`
+	Payload   interface{} `json:"payload"`
+}
+
+// BusMessage carries an encoded event between replicas over Redis pub/sub
+type BusMessage struct {
+	SessionID string          `json:"sessionId"`
+	Workspace string          `json:"workspace,omitempty"`
+	Event     json.RawMessage `json:"event"`
+	// Recipients limits delivery to these users, everyone subscribed receives the event when empty
+	Recipients []string `json:"recipients,omitempty"`
+}
+
+// Presence lists who is connected to a session and which of them have not voted yet
+type Presence struct {
+	Present  []string `json:"present"`
+	NotVoted []string `json:"notVoted"`
+}
+
+// CommandReply acknowledges or rejects a websocket command
+type CommandReply struct {
+	Type      string      `json:"type"`
+	RequestID string      `json:"requestId,omitempty"`
+	Status    int         `json:"status,omitempty"`
+	Message   string      `json:"message,omitempty"`
+	Payload   interface{} `json:"payload,omitempty"`
+}
+
+const (
+	modeBinary    = ""
+	modeQuadratic = "quadratic"
+	modeDots      = "dots"
+)
+
+// DelegationRequest delegates the caller's vote for either one session or a whole workspace
+type DelegationRequest struct {
+	Delegate  string `json:"delegate"`
+	SessionID string `json:"sessionId,omitempty"`
+	Workspace string `json:"workspace,omitempty"`
+}
+
+// BallotLog is the public, verifiable view of a session's ballots
+type BallotLog struct {
+	SessionID string   `json:"sessionId"`
+	Genesis   string   `json:"genesis"`
+	Head      string   `json:"head"`
+	Ballots   []Ballot `json:"ballots"`
+	Tally     Tally    `json:"tally"`
+	Valid     bool     `json:"valid"`
+}
+
+// BulkCreateRequest creates sessions from a list, fields left empty in an item are taken from the template
+type BulkCreateRequest struct {
+	Template VotingSession   `json:"template"`
+	Sessions []VotingSession `json:"sessions"`
+}
+
+// BulkSessionsRequest closes, archives or deletes the listed sessions
+type BulkSessionsRequest struct {
+	Ids []string `json:"ids"`
+	// Archive also removes closed sessions from the session lists
+	Archive bool `json:"archive,omitempty"`
+	// Versions optionally maps session IDs to the version they must still be at to be closed
+	Versions map[string]int64 `json:"versions,omitempty"`
+}
+
+// BulkResult is the outcome of one item of a bulk request, items succeed or fail independently
+type BulkResult struct {
+	Index   int    `json:"index"`
+	Id      string `json:"id,omitempty"`
+	Status  int    `json:"status"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// BulkResponse lists the result of every item in request order
+type BulkResponse struct {
+	Results   []BulkResult `json:"results"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+}
+
+// Webhook posts the events of one session or of a whole workspace to an external URL
+type Webhook struct {
+	Id        string   `json:"id"`
+	Owner     string   `json:"owner"`
+	URL       string   `json:"url"`
+	Secret    string   `json:"secret,omitempty"`
+	SessionID string   `json:"sessionId,omitempty"`
+	Workspace string   `json:"workspace,omitempty"`
+	Events    []string `json:"events"`
+	// Disabled is set once too many deliveries in a row have failed
+	Disabled  bool  `json:"disabled"`
+	CreatedAt int64 `json:"createdAt"`
+}
+
+// WebhookDelivery records the attempts to deliver one event to a webhook
+type WebhookDelivery struct {
+	Id             string          `json:"id"`
+	WebhookID      string          `json:"webhookId"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus int             `json:"responseStatus,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	// ReplayOf is the delivery this one was replayed from
+	ReplayOf  string `json:"replayOf,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+// IdempotencyRecord is the stored outcome of the first request made with an Idempotency-Key
+type IdempotencyRecord struct {
+	// Fingerprint is the hash of the request body, retries must send the same body
+	Fingerprint string `json:"fingerprint"`
+	// Status is 0 while the first request is still being processed
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// ChatOpsMessage is the reply to a slash command or button click, rendered by the chat platform
+type ChatOpsMessage struct {
+	// ResponseType is in_channel for messages everyone sees and ephemeral for replies only the user sees
+	ResponseType string          `json:"responseType"`
+	Text         string          `json:"text"`
+	SessionID    string          `json:"sessionId,omitempty"`
+	Buttons      []ChatOpsButton `json:"buttons,omitempty"`
+}
+
+// ChatOpsButton is an interactive button, its value is sent back in a ChatOpsAction when clicked
+type ChatOpsButton struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// ChatOpsAction is the callback of a button click
+type ChatOpsAction struct {
+	// Team is the chat workspace of the user, chat users act as chat:<team>:<user>
+	Team  string `json:"team"`
+	User  string `json:"user"`
+	Value string `json:"value"`
+}
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
 var (
 	sessions     AllSessions
 	sessionMutex sync.Mutex
-	grpcClient   pb.StreakAiServiceClient
-	upgrader     = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			// Allowing all origins for now
-			return true
-		}}
-	wsMutex     sync.Mutex
-	clients     = make(map[*websocket.Conn]bool)
-	redisClient *redis.Client
+	// ballotMutex serialises votes within this replica, across replicas the ballot chain is guarded by commitBallot
+	ballotMutex sync.Mutex
+	grpcClient  pb.StreakAiServiceClient
+	upgrader    = websocket.Upgrader{
+		CheckOrigin:  checkOrigin,
+		Subprotocols: []string{"bearer"},
+	}
+	allowedOrigins map[string]bool
+	hub            = newHub()
+	redisClient    *redis.Client
 )
+
+// APIError is the JSON body of every error response
+type APIError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"requestId,omitempty"`
+}
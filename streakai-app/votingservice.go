@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	pb "streakai/grpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// votingServiceAddr is where the public gRPC VotingService listens
+const votingServiceAddr = ":9090"
+
+// usernameKey stores the authenticated caller in a gRPC request context
+type usernameKey struct{}
+
+// votingServer implements the public gRPC VotingService on top of the same logic as the REST API
+type votingServer struct {
+	pb.UnimplementedVotingServiceServer
+}
+
+// serveVotingService starts the gRPC VotingService, calls are authenticated like the REST API
+func serveVotingService() error {
+	listener, err := net.Listen("tcp", votingServiceAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", votingServiceAddr, err)
+	}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(authUnaryInterceptor),
+		grpc.StreamInterceptor(authStreamInterceptor),
+	)
+	pb.RegisterVotingServiceServer(server, &votingServer{})
+	return server.Serve(listener)
+}
+
+// authenticate checks the bearer token of the call's metadata and stores the username in the context
+func authenticate(ctx context.Context) (context.Context, error) {
+	token, ok := callerToken(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Missing authorization metadata")
+	}
+	username, err := checkToken(token)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return context.WithValue(ctx, usernameKey{}, username), nil
+}
+
+// callerToken returns the bearer token of the call's authorization metadata
+func callerToken(ctx context.Context) (string, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", false
+	}
+	return strings.TrimPrefix(values[0], "Bearer "), true
+}
+
+// callerName returns the user authenticated by the interceptors
+func callerName(ctx context.Context) string {
+	username, _ := ctx.Value(usernameKey{}).(string)
+	return username
+}
+
+func authUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func authStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticatedStream carries the context with the caller's username into stream handlers
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcError maps a statusError to the gRPC code that grpcHTTPStatus turns back into its HTTP status
+func grpcError(err error) error {
+	se, ok := err.(*statusError)
+	if !ok {
+		return status.Error(codes.Internal, err.Error())
+	}
+	code := codes.Internal
+	switch se.status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnprocessableEntity:
+		code = codes.OutOfRange
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.Aborted
+	case http.StatusPreconditionFailed, http.StatusPreconditionRequired:
+		code = codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, se.message)
+}
+
+// CreateSession creates a session owned by the caller
+func (s *votingServer) CreateSession(ctx context.Context, req *pb.CreateSessionRequest) (*pb.CreateSessionResponse, error) {
+	session := &VotingSession{
+		Name:      req.Name,
+		Workspace: req.Workspace,
+		Mode:      req.Mode,
+		Options:   req.Options,
+		Credits:   int(req.Credits),
+		Dots:      int(req.Dots),
+		Weights:   req.Weights,
+		Quorum:    int(req.Quorum),
+	}
+	if err := createSession(callerName(ctx), session); err != nil {
+		return nil, grpcError(err)
+	}
+	view, err := protoSessionView(session)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.CreateSessionResponse{Message: "Session created", SessionId: session.Id, Session: view}, nil
+}
+
+// GetSession returns a session with its current tally
+func (s *votingServer) GetSession(ctx context.Context, req *pb.GetSessionRequest) (*pb.Session, error) {
+	session, err := getSession(req.Id)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return protoSessionView(session)
+}
+
+// ListSessions returns every session, or the sessions of one workspace
+func (s *votingServer) ListSessions(ctx context.Context, req *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error) {
+	var ids []string
+	var err error
+	if req.Workspace != "" {
+		ids, err = getWorkspaceSessionIDs(req.Workspace)
+	} else {
+		ids, err = getAllSessionIDs()
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	resp := &pb.ListSessionsResponse{}
+	for _, id := range ids {
+		session, err := getSession(id)
+		if err != nil {
+			log.Printf("Error loading session %s: %v", id, err)
+			continue
+		}
+		view, err := protoSessionView(session)
+		if err != nil {
+			return nil, err
+		}
+		resp.Sessions = append(resp.Sessions, view)
+	}
+	return resp, nil
+}
+
+// CastVote casts or changes the caller's vote and returns its receipt
+func (s *votingServer) CastVote(ctx context.Context, req *pb.CastVoteRequest) (*pb.CastVoteResponse, error) {
+	var allocation map[string]int
+	if len(req.Allocation) > 0 {
+		allocation = make(map[string]int, len(req.Allocation))
+		for option, votes := range req.Allocation {
+			allocation[option] = int(votes)
+		}
+	}
+
+	ballot, err := recordVote(callerName(ctx), SingleVote{Id: req.SessionId, Vote: req.Vote, Allocation: allocation, Change: req.Change})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.CastVoteResponse{
+		Message: "vote cast",
+		Receipt: &pb.VoteReceipt{SessionId: req.SessionId, Seq: int32(ballot.Seq), Voter: ballot.Voter, Hash: ballot.Hash},
+	}, nil
+}
+
+// UpdateSession replaces the editable fields of a session owned by the caller, at the version of the if-match metadata
+func (s *votingServer) UpdateSession(ctx context.Context, req *pb.UpdateSessionRequest) (*pb.Session, error) {
+	version, err := ifMatchVersion(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if version == nil {
+		return nil, status.Error(codes.FailedPrecondition, "if-match metadata with the session's version is required")
+	}
+
+	session, err := updateSession(callerName(ctx), req.Id, *version, &VotingSession{Name: req.Name, Weights: req.Weights, Quorum: int(req.Quorum)})
+	if err != nil {
+		log.Printf("Error updating session: %v", err)
+		return nil, grpcError(err)
+	}
+	return protoSessionView(session)
+}
+
+// CloseSession closes a session owned by the caller and returns its frozen result
+func (s *votingServer) CloseSession(ctx context.Context, req *pb.CloseSessionRequest) (*pb.CloseSessionResponse, error) {
+	version, err := ifMatchVersion(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if version == nil {
+		return nil, status.Error(codes.FailedPrecondition, "if-match metadata with the session's version is required")
+	}
+
+	tally, err := closeSession(callerName(ctx), req.Id, *version)
+	if err != nil {
+		log.Printf("Error closing session: %v", err)
+		return nil, grpcError(err)
+	}
+	return &pb.CloseSessionResponse{Message: "Session closed", Result: toProtoTally(tally)}, nil
+}
+
+// ifMatchVersion returns the version of the call's if-match metadata, forwarded from the If-Match header over REST, or nil without one
+func ifMatchVersion(ctx context.Context) (*int64, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("if-match")
+	if len(values) == 0 {
+		return nil, nil
+	}
+	version, err := parseIfMatch(values[0])
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// WatchSession streams a session's events, resuming after resume_from when the events are still buffered
+func (s *votingServer) WatchSession(req *pb.WatchSessionRequest, stream pb.VotingService_WatchSessionServer) error {
+	session, err := getSession(req.SessionId)
+	if err != nil {
+		return status.Error(codes.NotFound, err.Error())
+	}
+
+	token, _ := callerToken(stream.Context())
+	client := newClient(nil, callerName(stream.Context()), token)
+	hub.register(client)
+	defer hub.unregister(client)
+	hub.subscribe(client, ClientMessage{SessionID: req.SessionId})
+
+	// the stream ends like a websocket once the token expires or is revoked
+	stopped := make(chan string, 1)
+	go monitorToken(client.token, client.username, client.done, func(reason string) { stopped <- reason })
+
+	events, err := initialEvents(session, req.ResumeFrom)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	for _, data := range events {
+		if err := sendProtoEvent(stream, data); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case reason := <-stopped:
+			return status.Error(codes.Unauthenticated, reason)
+		case data, ok := <-client.send:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "Event stream fell behind")
+			}
+			if err := sendProtoEvent(stream, data); err != nil {
+				log.Printf("Error sending event to gRPC client: %v", err)
+				return err
+			}
+		}
+	}
+}
+
+// sendProtoEvent converts an encoded event envelope and sends it on the stream.
+// Session events carry the session view, every other payload is passed on as JSON.
+func sendProtoEvent(stream pb.VotingService_WatchSessionServer, data []byte) error {
+	event, err := decodeEvent(data)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	msg := &pb.SessionEvent{
+		Version:   int32(event.Version),
+		Type:      event.Type,
+		SessionId: event.SessionID,
+		Seq:       event.Seq,
+		Timestamp: timestamppb.New(event.Timestamp),
+	}
+	if carriesSession(event.Type) {
+		var view SessionView
+		if err := json.Unmarshal(event.Payload, &view); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		msg.Session = toProtoSession(&view)
+	} else {
+		msg.PayloadJson = string(event.Payload)
+	}
+	return stream.Send(msg)
+}
+
+// protoSessionView computes the view of a session and converts it to its protobuf message
+func protoSessionView(session *VotingSession) (*pb.Session, error) {
+	view, err := sessionView(session)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return toProtoSession(view), nil
+}
+
+// toProtoSession converts a session view to its protobuf message
+func toProtoSession(view *SessionView) *pb.Session {
+	session := &pb.Session{
+		Id:          view.Id,
+		Name:        view.Name,
+		Owner:       view.Owner,
+		Workspace:   view.Workspace,
+		Mode:        view.Mode,
+		Options:     view.Options,
+		Credits:     int32(view.Credits),
+		Dots:        int32(view.Dots),
+		Quorum:      int32(view.Quorum),
+		Version:     view.Version,
+		Archived:    view.Archived,
+		YesVoters:   view.YesCount,
+		NoVoters:    view.NoCount,
+		Weights:     view.Weights,
+		BallotHead:  view.BallotHead,
+		Closed:      view.Closed,
+		ClosedAt:    view.ClosedAt,
+		Result:      toProtoTally(view.Result),
+		Tally:       toProtoTally(&view.Tally),
+		Allocations: make(map[string]*structpb.Struct, len(view.Allocations)),
+	}
+	for user, allocation := range view.Allocations {
+		session.Allocations[user] = toProtoAllocation(allocation)
+	}
+	if view.RemainingCredits != nil {
+		session.RemainingCredits = toInt32Map(view.RemainingCredits)
+	}
+	for _, ranked := range view.Ranking {
+		session.Ranking = append(session.Ranking, &pb.RankedOption{Rank: int32(ranked.Rank), Option: ranked.Option, Total: ranked.Total})
+	}
+	if view.Presence != nil {
+		session.Presence = &pb.Presence{Present: view.Presence.Present, NotVoted: view.Presence.NotVoted}
+	}
+	return session
+}
+
+// toProtoAllocation converts the votes a user placed per option to the { option: n } object events carry
+func toProtoAllocation(allocation map[string]int) *structpb.Struct {
+	votes := &structpb.Struct{Fields: make(map[string]*structpb.Value, len(allocation))}
+	for option, n := range allocation {
+		votes.Fields[option] = structpb.NewNumberValue(float64(n))
+	}
+	return votes
+}
+
+func toProtoTally(tally *Tally) *pb.Tally {
+	if tally == nil {
+		return nil
+	}
+	return &pb.Tally{
+		Yes:          tally.Yes,
+		No:           tally.No,
+		DirectYes:    tally.DirectYes,
+		DirectNo:     tally.DirectNo,
+		DelegatedYes: tally.DelegatedYes,
+		DelegatedNo:  tally.DelegatedNo,
+		Delegations:  tally.Delegations,
+		Weights:      tally.Weights,
+		Options:      tally.Options,
+	}
+}
+
+func toInt32Map(values map[string]int) map[string]int32 {
+	converted := make(map[string]int32, len(values))
+	for key, value := range values {
+		converted[key] = int32(value)
+	}
+	return converted
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	pb "streakai/grpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// votingClient connects to the VotingService served by TestMain
+func votingClient(t *testing.T) pb.VotingServiceClient {
+	t.Helper()
+	conn, err := grpc.Dial("localhost"+votingServiceAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewVotingServiceClient(conn)
+}
+
+// asUser returns a context whose calls are authenticated as the user
+func asUser(ctx context.Context, user string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer token-"+user)
+}
+
+func TestGRPCErrorCodesMapBackToHTTP(t *testing.T) {
+	for _, httpStatus := range []int{
+		http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusConflict,
+		http.StatusPreconditionFailed, http.StatusUnprocessableEntity, http.StatusTooManyRequests,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout,
+	} {
+		err := grpcError(&statusError{status: httpStatus, message: "failed"})
+		if got := grpcHTTPStatus(err); got != httpStatus {
+			t.Errorf("%d became %v and then %d", httpStatus, status.Code(err), got)
+		}
+	}
+	if got := grpcHTTPStatus(grpcError(&statusError{status: http.StatusPreconditionRequired})); got != http.StatusPreconditionFailed {
+		t.Errorf("428 became %d", got)
+	}
+	if code := status.Code(grpcError(context.Canceled)); code != codes.Internal {
+		t.Errorf("a plain error became %v", code)
+	}
+}
+
+func TestVotingServiceStatusCodes(t *testing.T) {
+	client := votingClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	created, err := client.CreateSession(asUser(ctx, "alice"), &pb.CreateSessionRequest{Name: "grpc codes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := created.SessionId
+	vote := &pb.CastVoteRequest{SessionId: id, Vote: true}
+	if _, err := client.CastVote(asUser(ctx, "bob"), vote); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, call := range []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{"without a token", func() error { _, err := client.GetSession(ctx, &pb.GetSessionRequest{Id: id}); return err }(), codes.Unauthenticated},
+		{"with a bad token", func() error {
+			_, err := client.GetSession(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer nope"), &pb.GetSessionRequest{Id: id})
+			return err
+		}(), codes.Unauthenticated},
+		{"missing session", func() error {
+			_, err := client.GetSession(asUser(ctx, "bob"), &pb.GetSessionRequest{Id: "missing"})
+			return err
+		}(), codes.NotFound},
+		{"repeated vote", func() error { _, err := client.CastVote(asUser(ctx, "bob"), vote); return err }(), codes.Aborted},
+		{"close by another user", func() error {
+			_, err := client.CloseSession(metadata.AppendToOutgoingContext(asUser(ctx, "bob"), "if-match", `"2"`), &pb.CloseSessionRequest{Id: id})
+			return err
+		}(), codes.PermissionDenied},
+		{"close without a version", func() error {
+			_, err := client.CloseSession(asUser(ctx, "alice"), &pb.CloseSessionRequest{Id: id})
+			return err
+		}(), codes.FailedPrecondition},
+		{"close at a stale version", func() error {
+			_, err := client.CloseSession(metadata.AppendToOutgoingContext(asUser(ctx, "alice"), "if-match", `"1"`), &pb.CloseSessionRequest{Id: id})
+			return err
+		}(), codes.FailedPrecondition},
+		{"invalid session", func() error {
+			_, err := client.CreateSession(asUser(ctx, "alice"), &pb.CreateSessionRequest{Name: "negative", Weights: map[string]float64{"bob": -1}})
+			return err
+		}(), codes.InvalidArgument},
+	} {
+		if code := status.Code(call.err); code != call.want {
+			t.Errorf("%s: got %v (%v), want %v", call.name, code, call.err, call.want)
+		}
+	}
+}
+
+// nextSessionEvent receives the next event of the stream other than a presence change
+func nextSessionEvent(t *testing.T, stream pb.VotingService_WatchSessionClient) *pb.SessionEvent {
+	t.Helper()
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("the stream failed: %v", err)
+		}
+		if event.Type != eventPresenceChanged {
+			return event
+		}
+	}
+}
+
+func TestWatchSession(t *testing.T) {
+	client := votingClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	id := createTestSession(t, "alice", `{"name":"watched"}`)
+
+	stream, err := client.WatchSession(asUser(ctx, "alice"), &pb.WatchSessionRequest{SessionId: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := nextSessionEvent(t, stream); event.Type != eventSessionSnapshot || event.Session.GetId() != id {
+		t.Fatalf("the stream started with %v", event)
+	}
+	castTestVote(t, "bob", id)
+	vote := nextSessionEvent(t, stream)
+	if vote.Type != eventVoteCast || len(vote.Session.GetYesVoters()) != 1 || vote.Session.Tally.GetYes() != 1 {
+		t.Fatalf("vote streamed as %v", vote)
+	}
+	castTestVote(t, "carol", id)
+	next := nextSessionEvent(t, stream)
+
+	// resuming after the first vote replays the second one
+	resumed, err := client.WatchSession(asUser(ctx, "alice"), &pb.WatchSessionRequest{SessionId: id, ResumeFrom: &vote.Seq})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := nextSessionEvent(t, resumed); event.Seq != next.Seq || event.Type != eventVoteCast {
+		t.Errorf("resumed with %v, want seq %d", event, next.Seq)
+	}
+
+	missing, err := client.WatchSession(asUser(ctx, "alice"), &pb.WatchSessionRequest{SessionId: "missing"})
+	if err == nil {
+		_, err = missing.Recv()
+	}
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("watching a missing session: %v", err)
+	}
+}
+
+func TestWatchSessionEndsWhenTokenIsRevoked(t *testing.T) {
+	client := votingClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	id := createTestSession(t, "alice", `{"name":"watch revoke"}`)
+
+	stream, err := client.WatchSession(asUser(ctx, "frank"), &pb.WatchSessionRequest{SessionId: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextSessionEvent(t, stream)
+	revokeTestToken(t, "frank")
+	for {
+		event, err := stream.Recv()
+		if err == nil {
+			if event.Type != eventPresenceChanged {
+				t.Errorf("the stream went on with %v", event)
+			}
+			continue
+		}
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("the stream ended with %v", err)
+		}
+		return
+	}
+}
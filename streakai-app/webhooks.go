@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// webhookDeliveryLimit is how many deliveries are kept in the log of each webhook
+const webhookDeliveryLimit = 100
+
+// Headers of a webhook delivery, the signature is sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+const (
+	webhookEventHeader     = "X-Streakai-Event"
+	webhookDeliveryHeader  = "X-Streakai-Delivery"
+	webhookTimestampHeader = "X-Streakai-Timestamp"
+	webhookSignatureHeader = "X-Streakai-Signature"
+)
+
+var (
+	// a delivery is attempted webhookMaxAttempts times, waiting webhookRetryDelay and then twice as long after each failure
+	webhookMaxAttempts = 5
+	webhookRetryDelay  = time.Second
+	// pending attempts are scheduled in Redis, claimed for webhookClaimLease while they run, and
+	// every webhookSweepInterval each process resumes due ones, such as those of a stopped process
+	webhookClaimLease    = 30 * time.Second
+	webhookSweepInterval = 10 * time.Second
+	// webhookDisableAfter failed deliveries in a row disable a webhook
+	webhookDisableAfter int64 = 5
+	webhookClient             = &http.Client{
+		Timeout: 10 * time.Second,
+		// no proxy, so the dialer sees the real destination of every request and redirect
+		Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: checkWebhookDial}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+	}
+	// webhookMutex serialises changes to stored webhooks
+	webhookMutex sync.Mutex
+)
+
+// webhookEvents are the event types a webhook can subscribe to
+var webhookEvents = map[string]bool{
+	eventSessionCreated: true,
+	eventSessionUpdated: true,
+	eventSessionClosed:  true,
+	eventSessionQuorum:  true,
+	eventVoteCast:       true,
+}
+
+// defaultWebhookEvents are sent to webhooks that do not list their events
+var defaultWebhookEvents = []string{eventSessionCreated, eventSessionClosed, eventSessionQuorum}
+
+// handleWebhooks registers a webhook or lists the caller's webhooks
+func handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	username, isAuthorised := isAuthorised(w, r)
+	if !isAuthorised {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		webhooks, err := getUserWebhooks(username)
+		if err != nil {
+			sendError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		SendResponse(w, http.StatusOK, webhooks)
+		return
+	}
+
+	var webhook Webhook
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := createWebhook(username, &webhook); err != nil {
+		log.Printf("Error creating webhook: %v", err)
+		writeError(w, err)
+		return
+	}
+	SendResponse(w, http.StatusCreated, webhook)
+}
+
+// createWebhook validates and stores a webhook owned by username, generating its secret when none is given
+func createWebhook(username string, webhook *Webhook) error {
+	if err := validateWebhookURL(webhook.URL); err != nil {
+		return err
+	}
+	if (webhook.SessionID == "") == (webhook.Workspace == "") {
+		return &statusError{status: http.StatusBadRequest, message: "Exactly one of sessionId or workspace is required"}
+	}
+	if webhook.SessionID != "" {
+		session, err := getSession(webhook.SessionID)
+		if err != nil {
+			return &statusError{status: http.StatusNotFound, message: "Session not found"}
+		}
+		if session.Owner != username {
+			return &statusError{status: http.StatusForbidden, message: "Only the session owner can add webhooks to a session"}
+		}
+	}
+	if len(webhook.Events) == 0 {
+		webhook.Events = defaultWebhookEvents
+	}
+	for _, event := range webhook.Events {
+		if !webhookEvents[event] {
+			return &statusError{status: http.StatusBadRequest, message: "Unsupported webhook event " + event}
+		}
+	}
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return fmt.Errorf("failed to generate webhook secret: %v", err)
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+
+	webhook.Id = uuid.New().String()
+	webhook.Owner = username
+	webhook.Disabled = false
+	webhook.CreatedAt = time.Now().Unix()
+	if err := setWebhook(webhook); err != nil {
+		return err
+	}
+	log.Printf("%s added webhook %s for %s", username, webhook.Id, webhookScopeKey(webhook))
+	return nil
+}
+
+// validateWebhookURL accepts absolute http and https URLs that do not name an internal address
+func validateWebhookURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return &statusError{status: http.StatusBadRequest, message: "An absolute http or https url is required"}
+	}
+	if ip := net.ParseIP(parsed.Hostname()); ip != nil && isInternalIP(ip) {
+		return &statusError{status: http.StatusBadRequest, message: "Webhooks cannot target private, loopback or link-local addresses"}
+	}
+	return nil
+}
+
+// checkWebhookDial refuses connections to internal addresses once hostnames are resolved, so DNS cannot point a webhook inside the network
+func checkWebhookDial(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isInternalIP(ip) {
+		return fmt.Errorf("webhook destination %s is not allowed", address)
+	}
+	return nil
+}
+
+// isInternalIP reports loopback, private, link-local (including cloud metadata), multicast and unspecified addresses
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, also used inside some cloud networks
+var sharedAddressSpace = &net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)}
+
+// getUserWebhooks returns the webhooks owned by a user, without their secrets
+func getUserWebhooks(username string) ([]Webhook, error) {
+	ids, err := getWebhookIDs(userWebhooksKey(username))
+	if err != nil {
+		return nil, err
+	}
+	webhooks := make([]Webhook, 0, len(ids))
+	for _, id := range ids {
+		webhook, err := getWebhook(id)
+		if err != nil {
+			log.Printf("Error loading webhook %s: %v", id, err)
+			continue
+		}
+		webhook.Secret = ""
+		webhooks = append(webhooks, *webhook)
+	}
+	return webhooks, nil
+}
+
+// loadOwnedWebhook returns the webhook if the user owns it
+func loadOwnedWebhook(username string, id string) (*Webhook, error) {
+	webhook, err := getWebhook(id)
+	if err != nil {
+		return nil, &statusError{status: http.StatusNotFound, message: "Webhook not found"}
+	}
+	if webhook.Owner != username {
+		return nil, &statusError{status: http.StatusForbidden, message: "Only the webhook owner can manage it"}
+	}
+	return webhook, nil
+}
+
+// deleteWebhookHandler removes a webhook and its delivery log
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	username, isAuthorised := isAuthorised(w, r)
+	if !isAuthorised {
+		return
+	}
+
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+	webhook, err := loadOwnedWebhook(username, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := removeWebhook(webhook); err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	SendResponse(w, http.StatusOK, map[string]string{"message": "Webhook removed"})
+}
+
+// enableWebhookHandler re-enables a webhook that was disabled after failing deliveries
+func enableWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	username, isAuthorised := isAuthorised(w, r)
+	if !isAuthorised {
+		return
+	}
+
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+	webhook, err := loadOwnedWebhook(username, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	webhook.Disabled = false
+	if err := setWebhook(webhook); err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := resetWebhookFailures(webhook.Id); err != nil {
+		log.Printf("Error enabling webhook: %v", err)
+	}
+	webhook.Secret = ""
+	SendResponse(w, http.StatusOK, webhook)
+}
+
+// getWebhookDeliveriesHandler returns the delivery log of a webhook, newest first
+func getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	username, isAuthorised := isAuthorised(w, r)
+	if !isAuthorised {
+		return
+	}
+
+	webhook, err := loadOwnedWebhook(username, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	deliveries, err := getWebhookDeliveries(webhook.Id)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	SendResponse(w, http.StatusOK, deliveries)
+}
+
+// replayWebhookDeliveryHandler sends the payload of a logged delivery again as a new delivery
+func replayWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	username, isAuthorised := isAuthorised(w, r)
+	if !isAuthorised {
+		return
+	}
+
+	vars := mux.Vars(r)
+	webhook, err := loadOwnedWebhook(username, vars["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if webhook.Disabled {
+		sendError(w, "Webhook is disabled", http.StatusConflict)
+		return
+	}
+	original, err := getWebhookDelivery(webhook.Id, vars["deliveryId"])
+	if err != nil {
+		sendError(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+
+	delivery := newWebhookDelivery(webhook, original.Event, original.Payload)
+	delivery.ReplayOf = original.Id
+	if err := enqueueWebhookDelivery(delivery); err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	SendResponse(w, http.StatusAccepted, delivery)
+}
+
+// dispatchWebhooks delivers an event to the enabled webhooks of its session and workspace that subscribe to it
+func dispatchWebhooks(sessionID string, workspace string, eventType string, data []byte) {
+	if !webhookEvents[eventType] {
+		return
+	}
+
+	ids, err := getWebhookIDs(sessionWebhooksKey(sessionID))
+	if err != nil {
+		log.Printf("Error loading webhooks: %v", err)
+		return
+	}
+	if workspace != "" {
+		workspaceIDs, err := getWebhookIDs(workspaceWebhooksKey(workspace))
+		if err != nil {
+			log.Printf("Error loading webhooks: %v", err)
+			return
+		}
+		ids = append(ids, workspaceIDs...)
+	}
+
+	for _, id := range ids {
+		webhook, err := getWebhook(id)
+		if err != nil {
+			log.Printf("Error loading webhook %s: %v", id, err)
+			continue
+		}
+		if webhook.Disabled || !subscribesTo(webhook, eventType) {
+			continue
+		}
+		if err := enqueueWebhookDelivery(newWebhookDelivery(webhook, eventType, data)); err != nil {
+			log.Printf("Error queueing webhook delivery: %v", err)
+		}
+	}
+}
+
+func subscribesTo(webhook *Webhook, eventType string) bool {
+	for _, event := range webhook.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func newWebhookDelivery(webhook *Webhook, eventType string, payload json.RawMessage) *WebhookDelivery {
+	now := time.Now().Unix()
+	return &WebhookDelivery{
+		Id:        uuid.New().String(),
+		WebhookID: webhook.Id,
+		Event:     eventType,
+		Payload:   payload,
+		Status:    deliveryPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// enqueueWebhookDelivery logs a new delivery, schedules it in Redis so it survives restarts, and attempts it
+func enqueueWebhookDelivery(delivery *WebhookDelivery) error {
+	if err := saveWebhookDelivery(delivery); err != nil {
+		return err
+	}
+	if err := scheduleWebhookDelivery(delivery.WebhookID, delivery.Id, time.Now()); err != nil {
+		return err
+	}
+	go deliverWebhook(delivery.WebhookID, delivery.Id)
+	return nil
+}
+
+// resumeWebhookDeliveries attempts every scheduled delivery that is due, including those
+// left pending by a process that stopped
+func resumeWebhookDeliveries() {
+	due, err := getDueWebhookDeliveries(time.Now())
+	if err != nil {
+		log.Printf("Error loading scheduled webhook deliveries: %v", err)
+		return
+	}
+	for _, scheduled := range due {
+		go deliverWebhook(scheduled[0], scheduled[1])
+	}
+}
+
+// sweepWebhookDeliveries resumes due deliveries at startup and then every webhookSweepInterval
+func sweepWebhookDeliveries() {
+	for {
+		resumeWebhookDeliveries()
+		time.Sleep(webhookSweepInterval)
+	}
+}
+
+// deliverWebhook makes the next attempt of a scheduled delivery once this process claims it.
+// A failed attempt is rescheduled with exponential backoff, and the webhook is disabled
+// once webhookDisableAfter deliveries in a row have failed.
+func deliverWebhook(webhookID string, deliveryID string) {
+	claimed, err := claimWebhookDelivery(webhookID, deliveryID, time.Now(), webhookClaimLease)
+	if err != nil {
+		log.Printf("Error claiming webhook delivery: %v", err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	webhook, err := getWebhook(webhookID)
+	if err == nil {
+		var delivery *WebhookDelivery
+		if delivery, err = getWebhookDelivery(webhookID, deliveryID); err == nil && webhook.Disabled {
+			abandonWebhookDelivery(delivery)
+			return
+		} else if err == nil {
+			attemptWebhookDelivery(webhook, delivery)
+			return
+		}
+	}
+	// the webhook was removed or the delivery dropped from its log
+	log.Printf("Dropping webhook delivery %s: %v", deliveryID, err)
+	if err := unscheduleWebhookDelivery(webhookID, deliveryID); err != nil {
+		log.Printf("Error unscheduling webhook delivery: %v", err)
+	}
+}
+
+func attemptWebhookDelivery(webhook *Webhook, delivery *WebhookDelivery) {
+	responseStatus, err := postWebhook(webhook, delivery)
+	delivery.Attempts++
+	delivery.ResponseStatus = responseStatus
+	delivery.UpdatedAt = time.Now().Unix()
+	if err == nil {
+		delivery.Status = deliveryDelivered
+		delivery.Error = ""
+	} else {
+		delivery.Error = err.Error()
+		if delivery.Attempts >= webhookMaxAttempts {
+			delivery.Status = deliveryFailed
+		}
+	}
+	if err := saveWebhookDelivery(delivery); err != nil {
+		log.Printf("Error logging webhook delivery: %v", err)
+	}
+
+	if delivery.Status == deliveryPending {
+		delay := webhookRetryDelay << (delivery.Attempts - 1)
+		if err := scheduleWebhookDelivery(webhook.Id, delivery.Id, time.Now().Add(delay)); err != nil {
+			// the claim lease runs out and the sweep retries it
+			log.Printf("Error scheduling webhook retry: %v", err)
+		}
+		time.AfterFunc(delay, func() { deliverWebhook(webhook.Id, delivery.Id) })
+		return
+	}
+	if err := unscheduleWebhookDelivery(webhook.Id, delivery.Id); err != nil {
+		log.Printf("Error unscheduling webhook delivery: %v", err)
+	}
+
+	if delivery.Status == deliveryDelivered {
+		if err := resetWebhookFailures(webhook.Id); err != nil {
+			log.Printf("Error recording webhook delivery: %v", err)
+		}
+		return
+	}
+	log.Printf("Webhook %s failed to deliver %s: %s", webhook.Id, delivery.Id, delivery.Error)
+	failures, err := recordWebhookFailure(webhook.Id)
+	if err != nil {
+		log.Printf("Error recording webhook failure: %v", err)
+		return
+	}
+	if failures >= webhookDisableAfter {
+		disableWebhook(webhook.Id)
+	}
+}
+
+// abandonWebhookDelivery stops retrying a delivery of a webhook that was disabled meanwhile, the owner may replay
+// it once the webhook is enabled again
+func abandonWebhookDelivery(delivery *WebhookDelivery) {
+	delivery.Status = deliveryFailed
+	delivery.Error = "webhook is disabled"
+	delivery.UpdatedAt = time.Now().Unix()
+	if err := saveWebhookDelivery(delivery); err != nil {
+		log.Printf("Error logging webhook delivery: %v", err)
+	}
+	if err := unscheduleWebhookDelivery(delivery.WebhookID, delivery.Id); err != nil {
+		log.Printf("Error unscheduling webhook delivery: %v", err)
+	}
+}
+
+// postWebhook sends one signed delivery attempt, any status but 2xx is a failure
+func postWebhook(webhook *Webhook, delivery *WebhookDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "streakai-webhooks")
+	req.Header.Set(webhookEventHeader, delivery.Event)
+	req.Header.Set(webhookDeliveryHeader, delivery.Id)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, signWebhook(webhook.Secret, timestamp, delivery.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the signature header of a delivery body sent at timestamp
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// disableWebhook stops deliveries to a webhook until its owner enables it again
+func disableWebhook(id string) {
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+	webhook, err := getWebhook(id)
+	if err != nil {
+		// removed meanwhile
+		return
+	}
+	webhook.Disabled = true
+	if err := setWebhook(webhook); err != nil {
+		log.Printf("Error disabling webhook: %v", err)
+		return
+	}
+	log.Printf("Webhook %s disabled after %d failed deliveries in a row", id, webhookDisableAfter)
+}
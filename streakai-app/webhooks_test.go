@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookStub is a local webhook endpoint recording what it receives, failing while failures remain.
+// It is registered as webhookStubURL and reached through a client dialling the stub, as webhookClient refuses loopback addresses.
+type webhookStub struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	received []receivedWebhook
+}
+
+// webhookStubURL is the public looking URL webhooks are registered with in tests
+const webhookStubURL = "http://hooks.example.com/streakai"
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+func newWebhookStub(t *testing.T) *webhookStub {
+	stub := &webhookStub{}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+		stub.received = append(stub.received, receivedWebhook{header: r.Header.Clone(), body: body, at: time.Now()})
+		if stub.failures > 0 {
+			stub.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	client := webhookClient
+	webhookClient = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, stub.Listener.Addr().String())
+		},
+	}}
+	t.Cleanup(func() {
+		webhookClient = client
+		stub.Close()
+	})
+	return stub
+}
+
+func (stub *webhookStub) fail(n int) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	stub.failures = n
+}
+
+func (stub *webhookStub) requests() []receivedWebhook {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	return append([]receivedWebhook(nil), stub.received...)
+}
+
+// waitFor polls until the condition holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// registerTestWebhook adds a webhook for the session's vote.cast events pointing at the stub
+func registerTestWebhook(t *testing.T, owner string, sessionID string) *Webhook {
+	t.Helper()
+	resp, data := apiRequest(t, http.MethodPost, "/v1/webhooks", owner, nil,
+		`{"url":"`+webhookStubURL+`","sessionId":"`+sessionID+`","events":["vote.cast"],"secret":"s3cret"}`)
+	expectStatus(t, resp, data, http.StatusCreated)
+	var webhook Webhook
+	if err := json.Unmarshal(data, &webhook); err != nil {
+		t.Fatal(err)
+	}
+	return &webhook
+}
+
+func castTestVote(t *testing.T, voter string, sessionID string) {
+	t.Helper()
+	resp, data := apiRequest(t, http.MethodPatch, "/v1/sessions", voter, nil, `{"id":"`+sessionID+`","vote":true}`)
+	expectStatus(t, resp, data, http.StatusOK)
+}
+
+func TestWebhookSignatureAndRetries(t *testing.T) {
+	delay := webhookRetryDelay
+	webhookRetryDelay = 20 * time.Millisecond
+	defer func() { webhookRetryDelay = delay }()
+
+	stub := newWebhookStub(t)
+	sessionID := createTestSession(t, "alice", `{"name":"hooked"}`)
+	webhook := registerTestWebhook(t, "alice", sessionID)
+
+	stub.fail(2)
+	castTestVote(t, "bob", sessionID)
+	waitFor(t, "three attempts", func() bool { return len(stub.requests()) == 3 })
+
+	requests := stub.requests()
+	for _, request := range requests {
+		timestamp := request.header.Get(webhookTimestampHeader)
+		if got, want := request.header.Get(webhookSignatureHeader), signWebhook("s3cret", timestamp, request.body); got != want {
+			t.Errorf("signature %q, want %q", got, want)
+		}
+		if event := request.header.Get(webhookEventHeader); event != eventVoteCast {
+			t.Errorf("event header %q", event)
+		}
+		if request.header.Get(webhookDeliveryHeader) != requests[0].header.Get(webhookDeliveryHeader) {
+			t.Errorf("retries must keep the delivery ID")
+		}
+	}
+	var event Event
+	if err := json.Unmarshal(requests[0].body, &event); err != nil || event.Type != eventVoteCast || event.SessionID != sessionID {
+		t.Errorf("unexpected payload %s", requests[0].body)
+	}
+	// the delay doubles after each failed attempt
+	if first, second := requests[1].at.Sub(requests[0].at), requests[2].at.Sub(requests[1].at); first < webhookRetryDelay || second < 2*webhookRetryDelay {
+		t.Errorf("retries were %v and %v apart", first, second)
+	}
+
+	var deliveries []WebhookDelivery
+	waitFor(t, "the delivery to be logged", func() bool {
+		resp, data := apiRequest(t, http.MethodGet, "/v1/webhooks/"+webhook.Id+"/deliveries", "alice", nil, "")
+		expectStatus(t, resp, data, http.StatusOK)
+		json.Unmarshal(data, &deliveries)
+		return len(deliveries) == 1 && deliveries[0].Status == deliveryDelivered
+	})
+	if deliveries[0].Attempts != 3 || deliveries[0].ResponseStatus != http.StatusOK {
+		t.Errorf("delivery %+v", deliveries[0])
+	}
+}
+
+func TestWebhookDisableAndReplay(t *testing.T) {
+	attempts := webhookMaxAttempts
+	webhookMaxAttempts = 1
+	defer func() { webhookMaxAttempts = attempts }()
+
+	stub := newWebhookStub(t)
+	sessionID := createTestSession(t, "alice", `{"name":"failing hook"}`)
+	webhook := registerTestWebhook(t, "alice", sessionID)
+
+	stub.fail(int(webhookDisableAfter))
+	for _, voter := range []string{"v1", "v2", "v3", "v4", "v5"} {
+		castTestVote(t, voter, sessionID)
+	}
+	waitFor(t, "the webhook to be disabled", func() bool {
+		stored, err := getWebhook(webhook.Id)
+		return err == nil && stored.Disabled
+	})
+
+	resp, data := apiRequest(t, http.MethodGet, "/v1/webhooks/"+webhook.Id+"/deliveries", "alice", nil, "")
+	expectStatus(t, resp, data, http.StatusOK)
+	var deliveries []WebhookDelivery
+	json.Unmarshal(data, &deliveries)
+	if len(deliveries) != 5 {
+		t.Fatalf("%d deliveries logged", len(deliveries))
+	}
+	for _, delivery := range deliveries {
+		if delivery.Status != deliveryFailed || delivery.ResponseStatus != http.StatusInternalServerError {
+			t.Errorf("delivery %+v", delivery)
+		}
+	}
+
+	replay := "/v1/webhooks/" + webhook.Id + "/deliveries/" + deliveries[0].Id + "/replay"
+	resp, data = apiRequest(t, http.MethodPost, replay, "alice", nil, "")
+	expectStatus(t, resp, data, http.StatusConflict)
+	resp, data = apiRequest(t, http.MethodPost, "/v1/webhooks/"+webhook.Id+"/enable", "alice", nil, "")
+	expectStatus(t, resp, data, http.StatusOK)
+	resp, data = apiRequest(t, http.MethodPost, replay, "bob", nil, "")
+	expectStatus(t, resp, data, http.StatusForbidden)
+	resp, data = apiRequest(t, http.MethodPost, replay, "alice", nil, "")
+	expectStatus(t, resp, data, http.StatusAccepted)
+
+	var replayed WebhookDelivery
+	json.Unmarshal(data, &replayed)
+	if replayed.ReplayOf != deliveries[0].Id || replayed.Id == deliveries[0].Id {
+		t.Errorf("replay %+v", replayed)
+	}
+	waitFor(t, "the replay", func() bool { return len(stub.requests()) == 6 })
+	last := stub.requests()[5]
+	if string(last.body) != string(deliveries[0].Payload) || last.header.Get(webhookDeliveryHeader) != replayed.Id {
+		t.Errorf("replayed %s as %s", last.body, last.header.Get(webhookDeliveryHeader))
+	}
+}
+
+func TestWebhookResumesScheduledDeliveries(t *testing.T) {
+	stub := newWebhookStub(t)
+	sessionID := createTestSession(t, "alice", `{"name":"restarted"}`)
+	webhook := registerTestWebhook(t, "alice", sessionID)
+
+	// deliveries left scheduled by a process that stopped, one of them claimed by a process still attempting it
+	pending := newWebhookDelivery(webhook, eventVoteCast, json.RawMessage(`{"type":"vote.cast"}`))
+	claimed := newWebhookDelivery(webhook, eventVoteCast, json.RawMessage(`{"type":"vote.cast"}`))
+	for _, delivery := range []*WebhookDelivery{pending, claimed} {
+		if err := saveWebhookDelivery(delivery); err != nil {
+			t.Fatal(err)
+		}
+		if err := scheduleWebhookDelivery(webhook.Id, delivery.Id, time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := claimWebhookDelivery(webhook.Id, claimed.Id, time.Now(), time.Minute); !ok || err != nil {
+		t.Fatalf("claim failed: %v", err)
+	}
+
+	resumeWebhookDeliveries()
+	waitFor(t, "the pending delivery", func() bool {
+		delivery, err := getWebhookDelivery(webhook.Id, pending.Id)
+		return err == nil && delivery.Status == deliveryDelivered
+	})
+	requests := stub.requests()
+	if len(requests) != 1 || requests[0].header.Get(webhookDeliveryHeader) != pending.Id {
+		t.Fatalf("resumed %d deliveries", len(requests))
+	}
+	due, err := getDueWebhookDeliveries(time.Now().Add(2 * time.Minute))
+	if err != nil || len(due) != 1 || due[0][1] != claimed.Id {
+		t.Errorf("schedule after resuming: %v %v", due, err)
+	}
+	unscheduleWebhookDelivery(webhook.Id, claimed.Id)
+}
+
+func TestWebhookBlocksInternalDestinations(t *testing.T) {
+	sessionID := createTestSession(t, "alice", `{"name":"ssrf"}`)
+	for _, url := range []string{"http://127.0.0.1:9090/", "http://10.0.0.8/hook", "http://169.254.169.254/latest/meta-data", "http://[::1]/", "http://0.0.0.0/"} {
+		resp, data := apiRequest(t, http.MethodPost, "/v1/webhooks", "alice", nil, `{"url":"`+url+`","sessionId":"`+sessionID+`"}`)
+		expectStatus(t, resp, data, http.StatusBadRequest)
+	}
+
+	// a hostname resolving to an internal address is refused when dialled
+	listener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("webhook reached a loopback address")
+	}))
+	defer listener.Close()
+	_, err := webhookClient.Get(strings.Replace(listener.URL, "127.0.0.1", "localhost", 1))
+	if err == nil || !strings.Contains(err.Error(), "is not allowed") {
+		t.Fatalf("loopback dial was not refused: %v", err)
+	}
+	for _, address := range []string{"93.184.215.14:443", "93.184.215.14:9090"} {
+		if err := checkWebhookDial("tcp", address, nil); err != nil {
+			t.Errorf("a public address was refused: %v", err)
+		}
+	}
+}
+
+func TestWebhookStopsRetryingOnceDisabled(t *testing.T) {
+	delay := webhookRetryDelay
+	webhookRetryDelay = 100 * time.Millisecond
+	defer func() { webhookRetryDelay = delay }()
+
+	stub := newWebhookStub(t)
+	sessionID := createTestSession(t, "alice", `{"name":"disabled meanwhile"}`)
+	webhook := registerTestWebhook(t, "alice", sessionID)
+
+	stub.fail(webhookMaxAttempts)
+	castTestVote(t, "bob", sessionID)
+	waitFor(t, "the first attempt", func() bool { return len(stub.requests()) == 1 })
+	disableWebhook(webhook.Id)
+
+	var deliveries []WebhookDelivery
+	waitFor(t, "the delivery to be abandoned", func() bool {
+		deliveries, _ = getWebhookDeliveries(webhook.Id)
+		return len(deliveries) == 1 && deliveries[0].Status == deliveryFailed
+	})
+	if deliveries[0].Attempts != 1 || deliveries[0].Error != "webhook is disabled" {
+		t.Errorf("delivery %+v", deliveries[0])
+	}
+	time.Sleep(2 * webhookRetryDelay)
+	if requests := stub.requests(); len(requests) != 1 {
+		t.Errorf("%d attempts after the webhook was disabled", len(requests)-1)
+	}
+	due, _ := getDueWebhookDeliveries(time.Now().Add(time.Hour))
+	for _, entry := range due {
+		if entry[0] == webhook.Id {
+			t.Errorf("the delivery is still scheduled")
+		}
+	}
+}
+
+func TestWebhookIsNotReadAsSession(t *testing.T) {
+	sessionID := createTestSession(t, "alice", `{"name":"hook key"}`)
+	webhook := registerTestWebhook(t, "alice", sessionID)
+	resp, data := apiRequest(t, http.MethodGet, "/v1/sessions/"+webhookKey(webhook.Id), "alice", nil, "")
+	expectStatus(t, resp, data, http.StatusNotFound)
+	if _, err := getSession(eventSeqKey(sessionID)); err != errSessionNotFound {
+		t.Errorf("the event counter was read as a session: %v", err)
+	}
+}
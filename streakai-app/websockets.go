@@ -5,8 +5,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-
-	"github.com/gorilla/websocket"
 )
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
@@ -23,18 +21,39 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	token := websocketToken(r)
+	var username string
+	if token != "" {
+		var err error
+		username, err = checkToken(token)
+		if err != nil {
+			sendError(w, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Upgrade error: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sendError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	wsMutex.Lock()
-	clients[conn] = true
-	wsMutex.Unlock()
+	if token == "" {
+		token, username, err = authenticateFirstMessage(conn)
+		if err != nil {
+			writeAuthError(conn, err)
+			return
+		}
+	}
+
+	client := newClient(conn, username, token)
+	hub.register(client)
+	go client.writePump()
+	go client.readPump(hub)
+	go client.watchToken(hub)
 
-	log.Println("WebSocket connection established")
+	log.Printf("WebSocket connection established for %s", username)
 }
 
 func logAllSessions() {
@@ -46,22 +65,29 @@ func logAllSessions() {
 	}
 }
 
-func broadcastSessionStatus(session *VotingSession) {
+// broadcastSessionStatus pushes an event carrying the session's current state to its subscribers on every replica
+func broadcastSessionStatus(eventType string, session *VotingSession) {
+	event, err := newSessionEvent(eventType, session)
+	if err != nil {
+		log.Printf("Error building %s event: %v", eventType, err)
+		return
+	}
+	broadcastEvent(session, event)
+}
+
+// broadcastEvent buffers an event for replay and publishes it to every replica
+func broadcastEvent(session *VotingSession, event *Event) {
 	sessionMutex.Lock()
-	data, err := json.Marshal(session)
+	data, err := json.Marshal(event)
 	sessionMutex.Unlock()
 	if err != nil {
 		log.Printf("Error encoding session data: %v", err)
 		return
 	}
 
-	for client := range clients {
-		if err := client.WriteMessage(websocket.TextMessage, data); err != nil {
-			log.Printf("Error writing message to client: %v", err)
-			client.Close()
-			wsMutex.Lock()
-			delete(clients, client)
-			wsMutex.Unlock()
-		}
+	if err := appendEventLog(session.Id, data); err != nil {
+		log.Printf("Error buffering event for replay: %v", err)
 	}
+	publishEvent(BusMessage{SessionID: session.Id, Workspace: session.Workspace, Event: data})
+	go dispatchWebhooks(session.Id, session.Workspace, event.Type, data)
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsAuthTimeout bounds how long a connection may stay open before sending its token
+const wsAuthTimeout = 10 * time.Second
+
+// tokenRecheckInterval is how often a connection's token is checked for revocation
+var tokenRecheckInterval = time.Minute
+
+// parseAllowedOrigins splits a comma separated origin list such as ALLOWED_ORIGINS
+func parseAllowedOrigins(value string) map[string]bool {
+	origins := make(map[string]bool)
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins[strings.TrimSuffix(origin, "/")] = true
+		}
+	}
+	return origins
+}
+
+// checkOrigin accepts non-browser clients, same-origin pages and the configured allowlist
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if allowedOrigins["*"] || allowedOrigins[origin] {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	log.Printf("Rejected websocket origin %s", origin)
+	return false
+}
+
+// websocketToken returns the token sent in the Authorization header
+// or, for browsers that cannot set headers, as the "bearer, <token>" subprotocol pair
+func websocketToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == "bearer" && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+	return ""
+}
+
+// authenticateFirstMessage waits for an {"action": "auth", "token": "..."} message
+func authenticateFirstMessage(conn *websocket.Conn) (string, string, error) {
+	conn.SetReadDeadline(time.Now().Add(wsAuthTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var msg ClientMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		return "", "", err
+	}
+	if msg.Action != "auth" || msg.Token == "" {
+		return "", "", fmt.Errorf("first message must authenticate")
+	}
+
+	username, err := checkToken(msg.Token)
+	if err != nil {
+		return "", "", err
+	}
+	return msg.Token, username, nil
+}
+
+// watchToken disconnects the client once its token expires or the auth service stops accepting it
+func (c *Client) watchToken(h *Hub) {
+	monitorToken(c.token, c.username, c.done, func(reason string) { c.closeWith(h, reason) })
+}
+
+// monitorToken calls stop with the reason once the token expires or the auth service stops accepting it,
+// unless done is closed first
+func monitorToken(token string, username string, done <-chan struct{}, stop func(reason string)) {
+	var expired <-chan time.Time
+	if expiry, ok := tokenExpiry(token); ok {
+		timer := time.NewTimer(time.Until(expiry))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	ticker := time.NewTicker(tokenRecheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-expired:
+			log.Printf("Token of %s expired, closing connection", username)
+			stop("token expired")
+			return
+		case <-ticker.C:
+			if _, err := checkToken(token); err != nil {
+				log.Printf("Token of %s revoked, closing connection", username)
+				stop("token revoked")
+				return
+			}
+		}
+	}
+}
+
+// closeWith sends a policy violation close frame with the reason before dropping the client
+func (c *Client) closeWith(h *Hub, reason string) {
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(writeWait))
+	h.unregister(c)
+}
+
+// writeAuthError rejects a connection that failed to authenticate after the upgrade
+func writeAuthError(conn *websocket.Conn, err error) {
+	log.Printf("WebSocket authentication failed: %v", err)
+	data, _ := json.Marshal(map[string]string{"error": "Not Authorized"})
+	conn.WriteMessage(websocket.TextMessage, data)
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "not authorized"), time.Now().Add(time.Second))
+	conn.Close()
+}
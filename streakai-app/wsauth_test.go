@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialTestSocket opens a websocket to the test server with the given handshake headers
+func dialTestSocket(t *testing.T, headers map[string]string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	header := http.Header{}
+	for name, value := range headers {
+		header.Set(name, value)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testServerURL, "http")+"/v1/ws", header)
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+// expectClose reads until the server closes the connection and checks the close code and reason
+func expectClose(t *testing.T, conn *websocket.Conn, reason string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) || !strings.Contains(err.Error(), reason) {
+				t.Errorf("connection ended with %v, want %q", err, reason)
+			}
+			return
+		}
+	}
+}
+
+func TestWebSocketRejectsInvalidTokens(t *testing.T) {
+	if _, resp, err := dialTestSocket(t, map[string]string{"Authorization": "Bearer forged"}); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("a forged header token was accepted: %v", err)
+	}
+	if _, resp, err := dialTestSocket(t, map[string]string{"Sec-WebSocket-Protocol": "bearer, forged"}); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("a forged subprotocol token was accepted: %v", err)
+	}
+
+	for _, first := range []ClientMessage{{Action: "auth", Token: "forged"}, {Action: "subscribe", SessionID: "anything"}} {
+		conn, _, err := dialTestSocket(t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteJSON(first); err != nil {
+			t.Fatal(err)
+		}
+		expectClose(t, conn, "not authorized")
+	}
+}
+
+func TestWebSocketClosesOnRevokedToken(t *testing.T) {
+	conn, _, err := dialTestSocket(t, map[string]string{"Authorization": "Bearer token-revoked-ws"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokeTestToken(t, "revoked-ws")
+	expectClose(t, conn, "token revoked")
+}
+
+func TestWebSocketOriginAllowlist(t *testing.T) {
+	if _, resp, err := dialTestSocket(t, map[string]string{"Authorization": "Bearer token-bob", "Origin": "https://elsewhere.example"}); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("a foreign origin was accepted: %v", err)
+	}
+	if _, _, err := dialTestSocket(t, map[string]string{"Authorization": "Bearer token-bob", "Origin": testServerURL}); err != nil {
+		t.Errorf("the same origin was refused: %v", err)
+	}
+
+	configured := allowedOrigins
+	defer func() { allowedOrigins = configured }()
+	allowedOrigins = parseAllowedOrigins(" https://app.example/, https://admin.example")
+	for origin, want := range map[string]bool{
+		"":                          true,
+		"https://app.example":       true,
+		"https://admin.example":     true,
+		"https://admin.example:444": false,
+		"http://app.example":        false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://streakai.example/v1/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if checkOrigin(r) != want {
+			t.Errorf("origin %q allowed %t", origin, !want)
+		}
+	}
+}
@@ -4,11 +4,14 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	pb "streakauth/grpc"
 
 	"github.com/golang-jwt/jwt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Login handles user login requests
@@ -17,18 +20,18 @@ func (s *server) Login(ctx context.Context, in *pb.LoginRequest) (*pb.LoginRespo
 
 	if !isUserRegistered(in.Username) {
 		log.Printf("Username not found: %s", in.Username)
-		return &pb.LoginResponse{Token: ""}, fmt.Errorf("username not found")
+		return &pb.LoginResponse{Token: ""}, status.Error(codes.Unauthenticated, "username not found")
 	}
 
 	if registeredUsers[in.Username] != in.Password {
 		log.Printf("Invalid password for username: %s", in.Username)
-		return &pb.LoginResponse{Token: ""}, fmt.Errorf("invalid password")
+		return &pb.LoginResponse{Token: ""}, status.Error(codes.Unauthenticated, "invalid password")
 	}
 
 	tokenString, err := CreateToken(in.Username)
 	if err != nil {
 		log.Printf("Error generating token: %v", err)
-		return &pb.LoginResponse{Token: ""}, fmt.Errorf("error generating token")
+		return &pb.LoginResponse{Token: ""}, status.Error(codes.Internal, "error generating token")
 	}
 
 	loggedinUsers = append(loggedinUsers, in.Username)
@@ -42,18 +45,22 @@ func (s *server) LogOut(ctx context.Context, in *pb.LogOutRequest) (*pb.LogOutRe
 	log.Printf("Received Logout request: %v", in)
 
 	tokenString := in.AuthCode
+	if tokenString == "" {
+		tokenString = metadataToken(ctx)
+	}
 	if tokenString == "" {
 		log.Print("Missing authorization code")
-		return nil, fmt.Errorf("missing authorization code")
+		return nil, status.Error(codes.Unauthenticated, "missing authorization code")
 	}
 
 	_, err := verifyToken(tokenString)
 	if err != nil {
 		log.Printf("Invalid token: %v", err)
-		return nil, fmt.Errorf("invalid token")
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
 	}
 
 	removeFromLoggedIn(in.Username)
+	revokeToken(tokenString)
 	log.Printf("Logged out user: %s", in.Username)
 
 	return &pb.LogOutResponse{Status: "Logged Out"}, nil
@@ -63,15 +70,26 @@ func (s *server) LogOut(ctx context.Context, in *pb.LogOutRequest) (*pb.LogOutRe
 func (s *server) Register(ctx context.Context, in *pb.RegisterRequest) (*pb.RegisterResponse, error) {
 	log.Printf("Received Register request: %v", in)
 
+	if in.Username == "" || in.Password == "" {
+		log.Print("Missing username or password")
+		return &pb.RegisterResponse{Status: "failure"}, status.Error(codes.InvalidArgument, "username and password are required")
+	}
+
+	// ':' is reserved for the namespaced identities of chat users, e.g. chat:<team>:<user>
+	if strings.Contains(in.Username, ":") {
+		log.Printf("Invalid username: %s", in.Username)
+		return &pb.RegisterResponse{Status: "failure"}, status.Error(codes.InvalidArgument, "username must not contain ':'")
+	}
+
 	if isUserRegistered(in.Username) {
 		log.Printf("Username already registered: %s", in.Username)
-		return &pb.RegisterResponse{Status: "failure"}, fmt.Errorf("username already registered")
+		return &pb.RegisterResponse{Status: "failure"}, status.Error(codes.AlreadyExists, "username already registered")
 	}
 
 	registeredUsers[in.Username] = in.Password
 	log.Printf("Registered users: %v", registeredUsers)
 
-	return &pb.RegisterResponse{Status: "success"}, nil
+	return &pb.RegisterResponse{Status: "success", Message: "Registration successful"}, nil
 }
 
 // CreateToken generates a JWT token for a given username
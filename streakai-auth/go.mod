@@ -4,6 +4,7 @@ go 1.21.3
 
 require (
 	github.com/golang-jwt/jwt v3.2.2+incompatible
+	google.golang.org/genproto/googleapis/api v0.0.0-20240528184218-531527333157
 	google.golang.org/grpc v1.65.0
 	google.golang.org/protobuf v1.34.2
 )
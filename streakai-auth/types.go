@@ -1,6 +1,9 @@
 package main
 
-import pb "streakauth/grpc"
+import (
+	pb "streakauth/grpc"
+	"sync"
+)
 
 type server struct {
 	pb.UnimplementedStreakAiServiceServer
@@ -9,3 +12,7 @@ type server struct {
 var secretKey = []byte("secret-key")
 var registeredUsers = map[string]string{}
 var loggedinUsers = []string{}
+
+// revokedTokens holds tokens invalidated by logout
+var revokedTokens = map[string]bool{}
+var revokedMutex sync.Mutex
@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	pb "streakauth/grpc"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // CheckAuthorized handles authorization check requests
@@ -14,12 +18,27 @@ func (s *server) CheckAuthorized(ctx context.Context, in *pb.CheckAuthorizedReq)
 	username, err := verifyToken(in.AuthCode)
 	if err != nil {
 		log.Printf("Invalid token: %v", err)
-		return &pb.CheckAuthorizedRes{Username: "", Authorized: false}, fmt.Errorf("invalid token")
+		return &pb.CheckAuthorizedRes{Username: "", Authorized: false}, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	if isTokenRevoked(in.AuthCode) {
+		log.Printf("Revoked token used by %s", username)
+		return &pb.CheckAuthorizedRes{Username: "", Authorized: false}, status.Error(codes.Unauthenticated, "token revoked")
 	}
 
 	return &pb.CheckAuthorizedRes{Username: username, Authorized: true}, nil
 }
 
+// metadataToken returns the bearer token of the call's authorization metadata, as forwarded by the app's REST gateway
+func metadataToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(values[0], "Bearer ")
+}
+
 // isUserRegistered checks if a user is already registered
 func isUserRegistered(username string) bool {
 	_, exists := registeredUsers[username]
@@ -35,3 +54,17 @@ func removeFromLoggedIn(username string) {
 		}
 	}
 }
+
+// revokeToken marks a token as no longer valid
+func revokeToken(tokenString string) {
+	revokedMutex.Lock()
+	defer revokedMutex.Unlock()
+	revokedTokens[tokenString] = true
+}
+
+// isTokenRevoked checks if a token was revoked by logging out
+func isTokenRevoked(tokenString string) bool {
+	revokedMutex.Lock()
+	defer revokedMutex.Unlock()
+	return revokedTokens[tokenString]
+}